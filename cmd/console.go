@@ -3,6 +3,12 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -10,14 +16,35 @@ import (
 	"github.com/planetA/konk/docs"
 	"github.com/planetA/konk/pkg/container"
 	"github.com/planetA/konk/pkg/coordinator"
+	"github.com/planetA/konk/pkg/nymph"
 )
 
 var (
-	InteractiveMode bool   = false
-	Rank            int    = -1
-	Destination     string = ""
-	PreDump         bool   = false
-	WithPreDump     bool   = false
+	InteractiveMode bool     = false
+	Rank            int      = -1
+	Destination     string   = ""
+	PreDump         bool     = false
+	WithPreDump     bool     = false
+	PageServer      bool     = false
+	LazyPages       bool     = false
+	IterPreDump     bool     = false
+	MaxPreDumps     int      = 5
+	ConvergePages   uint64   = 1024
+	RateLimit       int      = 0
+	Detach          bool     = false
+	MigrationID     uint64   = 0
+	AllMigrations   bool     = false
+	WatchInterval   int      = 0
+	BatchMoves      []string = nil
+	Evacuate        string   = ""
+	BatchParallel   int      = 0
+	CheckpointRank  int      = -1
+	CheckpointDir   string   = ""
+	LeaveRunning    bool     = false
+	RestoreDir      string   = ""
+	RestoreHost     string   = ""
+	SignalNumber    int      = int(syscall.SIGTERM)
+	SignalRanks     []int    = nil
 )
 
 var consoleCmd = &cobra.Command{
@@ -38,18 +65,68 @@ var consoleCmd = &cobra.Command{
 	},
 }
 
+// Flags selecting the kind of migration are shared by migrate and migrate-batch
+func checkMigrationFlags(cmd *cobra.Command, args []string) error {
+	if PreDump == true && WithPreDump == true {
+		return fmt.Errorf("Flags pre-dump and with-pre-dump are conflicting")
+	}
+
+	if IterPreDump == true && (PreDump == true || WithPreDump == true) {
+		return fmt.Errorf("Flag iterative-pre-dump conflicts with pre-dump and with-pre-dump")
+	}
+
+	if LazyPages == true && (PreDump == true || WithPreDump == true || IterPreDump == true || PageServer == true) {
+		return fmt.Errorf("Flag lazy-pages conflicts with pre-dump, with-pre-dump, iterative-pre-dump and page-server")
+	}
+
+	return nil
+}
+
+func migrationTypeFromFlags() container.MigrationType {
+	switch {
+	case PreDump == true:
+		return container.PreDump
+	case WithPreDump == true:
+		return container.WithPreDump
+	case LazyPages == true:
+		return container.LazyPages
+	case IterPreDump == true:
+		return container.IterativePreDump
+	default:
+		return container.Migrate
+	}
+}
+
+func migrationOptsFromFlags() container.MigrationOpts {
+	return container.MigrationOpts{
+		PageServer:       PageServer,
+		MaxPreDumps:      MaxPreDumps,
+		ConvergencePages: ConvergePages,
+		RateLimit:        RateLimit,
+	}
+}
+
+func addMigrationFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&PreDump, "pre-dump", false, "Run predump command")
+	cmd.Flags().BoolVar(&WithPreDump, "with-pre-dump", false, "Migrate, but run predump command")
+
+	cmd.Flags().BoolVar(&IterPreDump, "iterative-pre-dump", false, "Migrate after pre-dumping until dirty memory converges")
+	cmd.Flags().IntVar(&MaxPreDumps, "max-pre-dumps", 5, "Maximum number of pre-dump rounds for iterative pre-dump")
+	cmd.Flags().Uint64Var(&ConvergePages, "converge-pages", 1024, "Iterative pre-dump stops once a round writes at most that many pages")
+
+	cmd.Flags().BoolVar(&LazyPages, "lazy-pages", false, "Restore at the destination immediately and fetch memory on demand")
+
+	cmd.Flags().BoolVar(&PageServer, "page-server", false, "Stream memory pages to a page server at the destination")
+
+	cmd.Flags().IntVar(&RateLimit, "rate-limit", 0, "Transfer rate limit in MiB/s (0: limit configured at the source, -1: unlimited)")
+}
+
 var migrateCmd = &cobra.Command{
 	TraverseChildren: true,
 	Use:              docs.ConsoleMigrateUse,
 	Short:            docs.ConsoleMigrateShort,
 	Long:             docs.ConsoleMigrateLong,
-	Args: func(cmd *cobra.Command, args []string) error {
-		if PreDump == true && WithPreDump == true {
-			return fmt.Errorf("Flags pre-dump and with-pre-dump are conflicting")
-		}
-
-		return nil
-	},
+	Args:             checkMigrationFlags,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		log.Debug("Executing migration command")
 
@@ -59,15 +136,7 @@ var migrateCmd = &cobra.Command{
 		}
 		defer coord.Close()
 
-		var migrationType container.MigrationType
-		switch {
-		case PreDump == true:
-			migrationType = container.PreDump
-		case WithPreDump == true:
-			migrationType = container.WithPreDump
-		default:
-			migrationType = container.Migrate
-		}
+		migrationType := migrationTypeFromFlags()
 
 		log.WithFields(log.Fields{
 			"rank": Rank,
@@ -75,9 +144,317 @@ var migrateCmd = &cobra.Command{
 			"type": migrationType,
 		}).Debug("Requesting migration")
 
-		if err := coord.Migrate(container.Rank(Rank), Destination, migrationType); err != nil {
+		opts := migrationOptsFromFlags()
+
+		if Detach {
+			id, err := coord.StartMigration(container.Rank(Rank), Destination, migrationType, opts)
+			if err != nil {
+				return fmt.Errorf("Migration failed: %v", err)
+			}
+
+			fmt.Println(id)
+			return nil
+		}
+
+		reply, err := coord.Migrate(container.Rank(Rank), Destination, migrationType, opts)
+		if err != nil {
 			return fmt.Errorf("Migration failed: %v", err)
 		}
+
+		printDumpStats(reply.Dumps)
+
+		if reply.RolledBack {
+			return fmt.Errorf("Migration failed and has been rolled back, rank %v keeps running at the source: %v", Rank, reply.Error)
+		}
+
+		if reply.PagesUnverified {
+			fmt.Println("Memory pages have been sent directly and were not verified")
+		}
+		return nil
+	},
+}
+
+// Print per-dump statistics of a migration as a table
+func printDumpStats(dumps []container.DumpStats) {
+	if len(dumps) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUND\tGENERATION\tTYPE\tSCANNED\tWRITTEN\tFROZEN\tELAPSED")
+	for i, dump := range dumps {
+		dumpType := "dump"
+		if dump.PreDump {
+			dumpType = "pre-dump"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", i+1, dump.Generation, dumpType,
+			dump.PagesScanned, dump.PagesWritten, dump.FrozenTime, dump.Elapsed)
+	}
+	w.Flush()
+}
+
+// Parse moves given as rank=host
+func parseMoves(moves []string) ([]coordinator.RankMove, error) {
+	parsed := make([]coordinator.RankMove, 0, len(moves))
+	for _, move := range moves {
+		parts := strings.SplitN(move, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Move %q is not of the form rank=host", move)
+		}
+
+		rank, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Move %q has an invalid rank: %v", move, err)
+		}
+
+		parsed = append(parsed, coordinator.RankMove{
+			Rank:     container.Rank(rank),
+			DestHost: parts[1],
+		})
+	}
+
+	return parsed, nil
+}
+
+var migrateBatchCmd = &cobra.Command{
+	TraverseChildren: true,
+	Use:              docs.ConsoleMigrateBatchUse,
+	Short:            docs.ConsoleMigrateBatchShort,
+	Long:             docs.ConsoleMigrateBatchLong,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if (Evacuate == "") == (len(BatchMoves) == 0) {
+			return fmt.Errorf("Either move or evacuate has to be given")
+		}
+
+		return checkMigrationFlags(cmd, args)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		moves, err := parseMoves(BatchMoves)
+		if err != nil {
+			return err
+		}
+
+		coord, err := coordinator.NewClient()
+		if err != nil {
+			return err
+		}
+		defer coord.Close()
+
+		outcomes, err := coord.MigrateBatch(&coordinator.MigrateBatchArgs{
+			Moves:         moves,
+			Evacuate:      Evacuate,
+			MigrationType: migrationTypeFromFlags(),
+			Opts:          migrationOptsFromFlags(),
+			Parallel:      BatchParallel,
+		})
+		if err != nil {
+			return fmt.Errorf("Batch migration failed: %v", err)
+		}
+
+		failed := 0
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "RANK\tSRC\tDEST\tID\tOUTCOME\tERROR")
+		for _, outcome := range outcomes {
+			if outcome.Outcome != coordinator.PhaseDone {
+				failed++
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", outcome.Rank, outcome.Src, outcome.Dest,
+				outcome.MigrationID, outcome.Outcome, outcome.Error)
+		}
+		w.Flush()
+
+		if failed > 0 {
+			return fmt.Errorf("%v of %v ranks did not migrate", failed, len(outcomes))
+		}
+		return nil
+	},
+}
+
+var migrationsCmd = &cobra.Command{
+	TraverseChildren: true,
+	Use:              docs.ConsoleMigrationsUse,
+	Short:            docs.ConsoleMigrationsShort,
+	Long:             docs.ConsoleMigrationsLong,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		coord, err := coordinator.NewClient()
+		if err != nil {
+			return err
+		}
+		defer coord.Close()
+
+		for {
+			finished := true
+			if MigrationID != 0 {
+				status, err := coord.MigrationStatus(MigrationID)
+				if err != nil {
+					return fmt.Errorf("Failed to get migration status: %v", err)
+				}
+
+				printMigrationPhases(status)
+				finished = status.Phase.Final()
+			} else {
+				statuses, err := coord.ListMigrations(AllMigrations)
+				if err != nil {
+					return fmt.Errorf("Failed to list migrations: %v", err)
+				}
+
+				printMigrations(statuses)
+				for _, status := range statuses {
+					if !status.Phase.Final() {
+						finished = false
+					}
+				}
+			}
+
+			if WatchInterval <= 0 || finished {
+				return nil
+			}
+
+			time.Sleep(time.Duration(WatchInterval) * time.Second)
+			fmt.Println()
+		}
+	},
+}
+
+func formatProgress(status *coordinator.MigrationStatus) string {
+	if status.BytesTotal == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.1f/%.1f MiB", float64(status.BytesSent)/(1<<20), float64(status.BytesTotal)/(1<<20))
+}
+
+func migrationElapsed(status *coordinator.MigrationStatus) time.Duration {
+	var elapsed time.Duration
+	for _, phase := range status.Phases {
+		elapsed += phase.Elapsed
+	}
+
+	return elapsed
+}
+
+// Print one line per migration
+func printMigrations(statuses []coordinator.MigrationStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRANK\tSRC\tDEST\tTYPE\tPHASE\tPROGRESS\tELAPSED\tERROR")
+	for i := range statuses {
+		status := &statuses[i]
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", status.ID, status.Rank, status.Src,
+			status.Dest, status.MigrationType, status.Phase, formatProgress(status),
+			migrationElapsed(status).Round(time.Millisecond), status.Error)
+	}
+	w.Flush()
+}
+
+// Print the phases of a migration as a table
+func printMigrationPhases(status *coordinator.MigrationStatus) {
+	fmt.Printf("Migration %v: rank %v from %v to %v, %v\n", status.ID, status.Rank, status.Src, status.Dest, status.Phase)
+	fmt.Printf("Transferred: %v\n", formatProgress(status))
+	if status.Error != "" {
+		fmt.Printf("Error: %v\n", status.Error)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tSTART\tELAPSED")
+	for _, phase := range status.Phases {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", phase.Phase, phase.Start.Format("15:04:05.000"), phase.Elapsed.Round(time.Millisecond))
+	}
+	w.Flush()
+}
+
+var checkpointCmd = &cobra.Command{
+	TraverseChildren: true,
+	Use:              docs.ConsoleCheckpointUse,
+	Short:            docs.ConsoleCheckpointShort,
+	Long:             docs.ConsoleCheckpointLong,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		hostname, err := requestCoordinatorLocation(container.Rank(CheckpointRank))
+		if err != nil {
+			return fmt.Errorf("Failed to locate rank %v: %v", CheckpointRank, err)
+		}
+
+		n, err := nymph.NewClient(hostname)
+		if err != nil {
+			return fmt.Errorf("Failed to connect to Nymph: %v", err)
+		}
+		defer n.Close()
+
+		log.WithFields(log.Fields{
+			"rank": CheckpointRank,
+			"host": hostname,
+			"dir":  CheckpointDir,
+		}).Debug("Requesting checkpoint")
+
+		reply, err := n.Checkpoint(container.Rank(CheckpointRank), CheckpointDir, LeaveRunning)
+		if err != nil {
+			return fmt.Errorf("Checkpoint failed: %v", err)
+		}
+
+		printDumpStats([]container.DumpStats{reply.Stats})
+		return nil
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	TraverseChildren: true,
+	Use:              docs.ConsoleRestoreUse,
+	Short:            docs.ConsoleRestoreShort,
+	Long:             docs.ConsoleRestoreLong,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		hostname := RestoreHost
+		if hostname == "" {
+			stored, err := container.LoadStoredCheckpoint(RestoreDir)
+			if err != nil {
+				return fmt.Errorf("Cannot choose a host, pass --host: %v", err)
+			}
+
+			hostname, err = requestCoordinatorAllocation(stored.Image.Rank)
+			if err != nil {
+				return fmt.Errorf("Failed to get host allocation: %v", err)
+			}
+		}
+
+		n, err := nymph.NewClient(hostname)
+		if err != nil {
+			return fmt.Errorf("Failed to connect to Nymph: %v", err)
+		}
+		defer n.Close()
+
+		rank, err := n.Restore(RestoreDir)
+		if err != nil {
+			return fmt.Errorf("Restore failed: %v", err)
+		}
+
+		fmt.Printf("Rank %v has been restored at %v\n", rank, hostname)
+		return nil
+	},
+}
+
+var signalCmd = &cobra.Command{
+	TraverseChildren: true,
+	Use:              docs.ConsoleSignalUse,
+	Short:            docs.ConsoleSignalShort,
+	Long:             docs.ConsoleSignalLong,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		coord, err := coordinator.NewClient()
+		if err != nil {
+			return err
+		}
+		defer coord.Close()
+
+		ranks := make([]container.Rank, len(SignalRanks))
+		for i, rank := range SignalRanks {
+			ranks[i] = container.Rank(rank)
+		}
+
+		log.WithFields(log.Fields{
+			"signal": SignalNumber,
+			"ranks":  ranks,
+		}).Debug("Requesting signal delivery")
+
+		if err := coord.Signal(syscall.Signal(SignalNumber), ranks...); err != nil {
+			return fmt.Errorf("Signal delivery failed: %v", err)
+		}
 		return nil
 	},
 }
@@ -89,14 +466,44 @@ func init() {
 	migrateCmd.Flags().StringVar(&Destination, "dest", "", "New destination of a rank")
 	migrateCmd.MarkFlagRequired("dest")
 
-	migrateCmd.Flags().BoolVar(&PreDump, "pre-dump", false, "Run predump command")
-	migrateCmd.MarkFlagRequired("dest")
+	addMigrationFlags(migrateCmd)
 
-	migrateCmd.Flags().BoolVar(&WithPreDump, "with-pre-dump", false, "Migrate, but run predump command")
-	migrateCmd.MarkFlagRequired("dest")
+	migrateCmd.Flags().BoolVar(&Detach, "detach", false, "Print the migration ID and return without waiting for the migration")
 
 	consoleCmd.AddCommand(migrateCmd)
 
+	migrateBatchCmd.Flags().StringSliceVar(&BatchMoves, "move", nil, "Move a rank to a host, given as rank=host")
+	migrateBatchCmd.Flags().StringVar(&Evacuate, "evacuate", "", "Move all ranks away from the host")
+	migrateBatchCmd.Flags().IntVar(&BatchParallel, "parallel", 0, "Number of ranks migrating at the same time (0: no limit besides the coordinator)")
+	addMigrationFlags(migrateBatchCmd)
+
+	consoleCmd.AddCommand(migrateBatchCmd)
+
+	migrationsCmd.Flags().Uint64Var(&MigrationID, "id", 0, "Show the phases of a single migration")
+	migrationsCmd.Flags().BoolVar(&AllMigrations, "all", false, "Include recently finished migrations")
+	migrationsCmd.Flags().IntVarP(&WatchInterval, "watch", "w", 0, "Refresh every that many seconds until the migrations finish")
+
+	consoleCmd.AddCommand(migrationsCmd)
+
+	checkpointCmd.Flags().IntVar(&CheckpointRank, "rank", -1, "Rank to checkpoint")
+	checkpointCmd.MarkFlagRequired("rank")
+	checkpointCmd.Flags().StringVar(&CheckpointDir, "to", "", "Directory to store the checkpoint in, as seen by the nymph")
+	checkpointCmd.MarkFlagRequired("to")
+	checkpointCmd.Flags().BoolVar(&LeaveRunning, "leave-running", false, "Keep the rank running after the checkpoint")
+
+	consoleCmd.AddCommand(checkpointCmd)
+
+	restoreCmd.Flags().StringVar(&RestoreDir, "from", "", "Directory holding the checkpoint")
+	restoreCmd.MarkFlagRequired("from")
+	restoreCmd.Flags().StringVar(&RestoreHost, "host", "", "Nymph to restore the rank at (chosen by the coordinator, if omitted)")
+
+	consoleCmd.AddCommand(restoreCmd)
+
+	signalCmd.Flags().IntVarP(&SignalNumber, "signal", "s", int(syscall.SIGTERM), "Signal number to deliver")
+	signalCmd.Flags().IntSliceVar(&SignalRanks, "rank", nil, "Ranks to signal (all ranks, if omitted)")
+
+	consoleCmd.AddCommand(signalCmd)
+
 	consoleCmd.Flags().BoolVarP(&InteractiveMode, "interactive", "i", false, "Run console in interactive mode")
 	KonkCmd.AddCommand(consoleCmd)
 }
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/planetA/konk/pkg/coordinator"
+)
+
+func TestParseMoves(t *testing.T) {
+	moves, err := parseMoves([]string{"0=node1", "12=node2", "3=node=3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []coordinator.RankMove{
+		{Rank: 0, DestHost: "node1"},
+		{Rank: 12, DestHost: "node2"},
+		{Rank: 3, DestHost: "node=3"},
+	}
+	if !reflect.DeepEqual(moves, expected) {
+		t.Errorf("Expected %v, got %v", expected, moves)
+	}
+
+	for _, bad := range []string{"node1", "0=", "=node1", "x=node1", "-=node1"} {
+		if moves, err := parseMoves([]string{"1=node1", bad}); err == nil {
+			t.Errorf("Move %q should be rejected, got %v", bad, moves)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -15,6 +16,15 @@ import (
 	"github.com/planetA/konk/pkg/nymph"
 )
 
+const (
+	// How long to look for a rank, that has lost its nymph, before giving up
+	restartTimeout = 2 * time.Minute
+
+	// The coordinator is asked for the new location of a rank with a growing delay
+	locateDelayMin = 100 * time.Millisecond
+	locateDelayMax = 5 * time.Second
+)
+
 func requestCoordinatorAllocation(rank container.Rank) (string, error) {
 	c, err := coordinator.NewClient()
 	if err != nil {
@@ -25,6 +35,80 @@ func requestCoordinatorAllocation(rank container.Rank) (string, error) {
 	return c.AllocateHost(rank)
 }
 
+func requestCoordinatorLocation(rank container.Rank) (string, error) {
+	c, err := coordinator.NewClient()
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	return c.LocateContainer(rank)
+}
+
+func waitOnce(rank container.Rank, hostname string) (*nymph.WaitReply, error) {
+	n, err := nymph.NewClientOnce(hostname)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to Nymph: %v", err)
+	}
+	defer n.Close()
+
+	return n.Wait(rank)
+}
+
+// Wait until the container exits. If the container migrates, the coordinator tells where
+// to wait next.
+func waitContainer(rank container.Rank, hostname string) (container.ExitStatus, error) {
+	delay := locateDelayMin
+	var unchangedSince time.Time
+	for {
+		reply, waitErr := waitOnce(rank, hostname)
+		if waitErr == nil && reply.Checkpointed {
+			log.WithField("rank", rank).Info("Container has been checkpointed")
+			return reply.Status, nil
+		}
+
+		if waitErr == nil && !reply.Migrated {
+			return reply.Status, nil
+		}
+
+		newHostname, err := requestCoordinatorLocation(rank)
+		if err == nil && newHostname != hostname {
+			log.WithFields(log.Fields{
+				"rank": rank,
+				"old":  hostname,
+				"new":  newHostname,
+			}).Debug("Container has migrated, continue waiting")
+
+			hostname = newHostname
+			delay = locateDelayMin
+			unchangedSince = time.Time{}
+			continue
+		}
+
+		// The coordinator learns about a finished migration a bit after the donor has let
+		// the container go, and about a dead nymph only after the dead timeout. If the
+		// migration has been rolled back, the next wait blocks at the same nymph again.
+		if unchangedSince.IsZero() {
+			unchangedSince = time.Now()
+		}
+
+		if time.Since(unchangedSince) > restartTimeout {
+			if waitErr != nil {
+				return container.ExitStatus{}, waitErr
+			}
+			if err != nil {
+				return container.ExitStatus{}, fmt.Errorf("Failed to locate migrated container: %v", err)
+			}
+			return container.ExitStatus{}, fmt.Errorf("Container has left %v, but did not show up elsewhere", hostname)
+		}
+
+		time.Sleep(delay)
+		if delay *= 2; delay > locateDelayMax {
+			delay = locateDelayMax
+		}
+	}
+}
+
 var RunCmd = &cobra.Command{
 	Use:   docs.RunUse,
 	Short: docs.RunShort,
@@ -48,34 +132,44 @@ var RunCmd = &cobra.Command{
 		if err != nil {
 			return fmt.Errorf("Failed to connect to Nymph: %v", err)
 		}
-		defer n.Close()
 
 		init, err := config.GetBool(config.ContainerInit)
 		if err != nil {
 			init = false
 		}
 
-		if err := n.Run(&nymph.RunArgs{
+		checkpointInterval, _ := config.GetIntOk(config.ContainerCheckpointInterval)
+
+		err = n.Run(&nymph.RunArgs{
 			Rank:  containerRank,
 			Image: image,
 			Args:  args,
 			Init:  init,
-		}); err != nil {
+
+			CheckpointInterval: checkpointInterval,
+		})
+		n.Close()
+		if err != nil {
 			log.WithFields(log.Fields{
 				"containerRank": containerRank,
 				"image":         image,
 				"args":          args}).Error("Failed to launch container")
+			return fmt.Errorf("Failed to launch container: %v", err)
 		}
 
 		log.Info("Running container")
 
-		ret, err := n.Wait(containerRank)
+		ret, err := waitContainer(containerRank, hostname)
 		if err != nil {
 			return fmt.Errorf("Waiting failed: %v", err)
 		}
 
 		log.WithField("Return value", ret).Info("Process finished")
 
+		if ret.ExitCode() != 0 {
+			os.Exit(ret.ExitCode())
+		}
+
 		return nil
 	},
 }
@@ -101,6 +195,9 @@ func init() {
 	RunCmd.Flags().Bool("init", true, "Tell if the process should be init process")
 	config.BindPFlag(config.ContainerInit, RunCmd.Flags().Lookup("init"))
 
+	RunCmd.Flags().Int("checkpoint-interval", 0, "Seconds between periodic checkpoints (0: nymph default, negative: disabled)")
+	config.BindPFlag(config.ContainerCheckpointInterval, RunCmd.Flags().Lookup("checkpoint-interval"))
+
 	KonkCmd.AddCommand(RunCmd)
 }
 
@@ -15,14 +15,44 @@ type ViperKey string
 
 // Constants used by viper to lookup configuration
 const (
-	NymphHost     ViperKey = "nymph.host"
-	NymphPort              = "nymph.port"
-	NymphRootDir           = "nymph.root_dir"
-	NymphCniPath           = "nymph.cni_path"
-	NymphNetworks          = "nymph.networks"
-
-	CoordinatorHost = "coordinator.host"
-	CoordinatorPort = "coordinator.port"
+	NymphHost                    ViperKey = "nymph.host"
+	NymphPort                             = "nymph.port"
+	NymphRootDir                          = "nymph.root_dir"
+	NymphCniPath                          = "nymph.cni_path"
+	NymphNetworks                         = "nymph.networks"
+	NymphHeartbeatInterval                = "nymph.heartbeat_interval"
+	NymphCriuPath                         = "nymph.criu_path"
+	NymphMigrationCompression             = "nymph.migration.compression"
+	NymphMigrationParallelFiles           = "nymph.migration.parallel_files"
+	NymphMigrationWindow                  = "nymph.migration.window"
+	NymphMigrationSessionTimeout          = "nymph.migration.session_timeout"
+	NymphMigrationResumeAttempts          = "nymph.migration.resume_attempts"
+	NymphMigrationRateLimit               = "nymph.migration.rate_limit"
+	NymphMigrationTotalRateLimit          = "nymph.migration.total_rate_limit"
+	NymphMigrationDataPort                = "nymph.migration.data_port"
+	NymphCheckpointInterval               = "nymph.checkpoint.interval"
+	NymphCheckpointKeep                   = "nymph.checkpoint.keep"
+	NymphCheckpointStorage                = "nymph.checkpoint.storage"
+	NymphCheckpointBuddies                = "nymph.checkpoint.buddies"
+
+	CoordinatorHost      = "coordinator.host"
+	CoordinatorPort      = "coordinator.port"
+	CoordinatorStateType = "coordinator.state.type"
+	CoordinatorStatePath = "coordinator.state.path"
+
+	CoordinatorSuspectTimeout = "coordinator.heartbeat.suspect_timeout"
+	CoordinatorDeadTimeout    = "coordinator.heartbeat.dead_timeout"
+
+	CoordinatorSchedulerPolicy      = "coordinator.scheduler.policy"
+	CoordinatorSchedulerInterval    = "coordinator.scheduler.interval"
+	CoordinatorSchedulerMaxPerNymph = "coordinator.scheduler.max_per_nymph"
+
+	CoordinatorMinFreeMemory = "coordinator.allocation.min_free_memory"
+
+	CoordinatorMigrationConcurrency = "coordinator.migration.concurrency"
+
+	CoordinatorRestartAttempts = "coordinator.restart.attempts"
+	CoordinatorRestartDelay    = "coordinator.restart.delay"
 
 	ContainerRank     = "container.rank"
 	ContainerRankEnv  = "container.rank_env"
@@ -33,6 +63,8 @@ const (
 	ContainerHostname = "container.hostname"
 	ContainerInit     = "container.init"
 
+	ContainerCheckpointInterval = "container.checkpoint_interval"
+
 	ContainerDevicePath = "container.device.path"
 
 	KonkSysLauncher = "konk-sys.launcher"
@@ -85,6 +117,13 @@ func GetStringSlice(key ViperKey) []string {
 	return viper.GetStringSlice(string(key))
 }
 
+func GetStringSliceOk(key ViperKey) ([]string, bool) {
+	if !viper.IsSet(string(key)) {
+		return nil, false
+	}
+	return viper.GetStringSlice(string(key)), true
+}
+
 func GetBool(key ViperKey) (bool, error) {
 	if !viper.IsSet(string(key)) {
 		return false, fmt.Errorf("The key '%v' was not set and does not have a default value", key)
@@ -21,6 +21,31 @@ const (
 	ConsoleMigrateShort string = `Migrate rank from ane node to another`
 	ConsoleMigrateLong  string = ``
 
+	ConsoleMigrateBatchUse   string = `migrate-batch [--move rank=host]... [--evacuate host] [flags]`
+	ConsoleMigrateBatchShort string = `Migrate many ranks at once or evacuate a node`
+	ConsoleMigrateBatchLong  string = `Either moves the listed ranks to their destinations, or moves all ranks away from the
+evacuated node to the least loaded nodes. Reports the outcome for every rank.`
+
+	ConsoleMigrationsUse   string = `migrations [flags]`
+	ConsoleMigrationsShort string = `Show the status of migrations`
+	ConsoleMigrationsLong  string = `Lists queued and running migrations with their current phase and transfer progress.
+With --id, shows the phases of a single migration and how long each of them took.`
+
+	ConsoleCheckpointUse   string = `checkpoint --rank <rank> --to <dir> [flags]`
+	ConsoleCheckpointShort string = `Store a checkpoint of a rank in a directory`
+	ConsoleCheckpointLong  string = `Dumps the rank into a directory, that outlives the nymph, e.g., on a shared file system.
+The rank stops, unless --leave-running is given. The checkpoint can be restored later with
+the restore command at any nymph.`
+
+	ConsoleRestoreUse   string = `restore --from <dir> [--host <host>]`
+	ConsoleRestoreShort string = `Restore a rank from a stored checkpoint`
+	ConsoleRestoreLong  string = `Restores a rank from a directory written by the checkpoint command. Without --host,
+the coordinator chooses the nymph; the directory must then be readable by the console as well.`
+
+	ConsoleSignalUse   string = `signal <args>`
+	ConsoleSignalShort string = `Send a signal to all ranks or to selected ranks`
+	ConsoleSignalLong  string = ``
+
 	MpirunUse   string = `mpirun <image> <program> <args>`
 	MpirunShort string = `Wrapper for the mpirun command`
 	MpirunLong  string = ``
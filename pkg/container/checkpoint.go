@@ -6,7 +6,10 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"time"
 
+	"github.com/checkpoint-restore/go-criu/stats"
+	"github.com/golang/protobuf/proto"
 	"github.com/opencontainers/runc/libcontainer"
 	log "github.com/sirupsen/logrus"
 )
@@ -17,6 +20,10 @@ const (
 	Migrate MigrationType = iota
 	PreDump
 	WithPreDump
+	// Restore at the recipient right away, memory pages are pulled from the donor on demand
+	LazyPages
+	// Repeat pre-dumps until the amount of dirty memory converges, then migrate
+	IterativePreDump
 )
 
 func (m MigrationType) String() string {
@@ -27,11 +34,60 @@ func (m MigrationType) String() string {
 		return "pre-dump"
 	case WithPreDump:
 		return "migrate-with-pre-dump"
+	case LazyPages:
+		return "lazy-pages"
+	case IterativePreDump:
+		return "migrate-with-iterative-pre-dump"
 	default:
 		panic("Unreachable")
 	}
 }
 
+// Options, that tune how a migration is performed
+type MigrationOpts struct {
+	// Stream memory pages directly to a CRIU page server at the recipient
+	PageServer bool
+	// Upper limit of pre-dump rounds for the iterative pre-dump
+	MaxPreDumps int
+	// Iterative pre-dump stops, once a round writes at most that many pages
+	ConvergencePages uint64
+	// Transfer rate limit in MiB/s. Zero means the limit configured at the donor, a negative
+	// value lifts it. The limit of all migrations of the donor applies in any case.
+	RateLimit int
+}
+
+// Statistics of a single dump as reported by CRIU
+type DumpStats struct {
+	Generation   int
+	PreDump      bool
+	PagesScanned uint64
+	PagesWritten uint64
+	// Time the process has been frozen
+	FrozenTime time.Duration
+	// Time the whole dump took
+	Elapsed time.Duration
+}
+
+// Options for dumping a checkpoint
+type DumpOpts struct {
+	PreDump bool
+	// Keep the process running after a full dump
+	LeaveRunning bool
+	// If set, memory pages are sent to the CRIU page server instead of the image directory.
+	// For lazy dump, it is the address the donor serves the pages at.
+	PageServer *libcontainer.CriuPageServerInfo
+	// Leave memory pages at the donor and serve them on demand
+	LazyPages bool
+	// Path to a file, that receives a byte once the lazy pages can be served
+	StatusFd string
+}
+
+// Options for restoring a checkpoint
+type RestoreOpts struct {
+	// Memory pages are fetched on demand by the lazy-pages daemon
+	LazyPages bool
+}
+
 type Checkpoint interface {
 	// Id of a checkpoint
 	Generation() int
@@ -41,11 +97,14 @@ type Checkpoint interface {
 
 	Rank() Rank
 
+	// Checkpoint, that this checkpoint is based on, or nil
+	Parent() Checkpoint
+
 	// Dump process into checkpoint
-	Dump(preDump bool) error
+	Dump(opts DumpOpts) error
 
 	// Restore process from checkpoint
-	Restore(process *libcontainer.Process) error
+	Restore(process *libcontainer.Process, opts RestoreOpts) error
 
 	// Path to the current state file
 	StatePath() string
@@ -60,6 +119,9 @@ type Checkpoint interface {
 	Args() []string
 
 	ImageInfo() *ImageInfoArgs
+
+	// Statistics of the last dump into the checkpoint
+	Stats() (*DumpStats, error)
 }
 
 type checkpoint struct {
@@ -99,26 +161,100 @@ func (c *Container) NewCheckpoint(parent Checkpoint) (Checkpoint, error) {
 	return checkpoint, nil
 }
 
-func (c *Container) LoadCheckpoint(target int) error {
-	ckptPath := path.Join(c.CheckpointsPath(), strconv.Itoa(target))
+// Forget the checkpoint and remove its images. Checkpoints based on it become unusable.
+func (c *Container) RemoveCheckpoint(generation int) error {
+	for i, ckpt := range c.checkpoints {
+		if ckpt.Generation() != generation {
+			continue
+		}
+
+		c.checkpoints = append(c.checkpoints[:i], c.checkpoints[i+1:]...)
+		return os.RemoveAll(ckpt.PathAbs())
+	}
+
+	return fmt.Errorf("Checkpoint %v not found", generation)
+}
+
+// Name of the link, that CRIU follows from the images of a checkpoint to the images of its parent
+const parentLink = "parent"
+
+// Generation of the parent of the checkpoint in the directory, or -1, if the checkpoint has no parent
+func parentGeneration(dir string) (int, error) {
+	target, err := os.Readlink(path.Join(dir, parentLink))
+	if os.IsNotExist(err) {
+		return -1, nil
+	} else if err != nil {
+		return -1, err
+	}
+
+	generation, err := strconv.Atoi(path.Base(target))
+	if err != nil {
+		return -1, fmt.Errorf("Unexpected parent of %v: %v", dir, target)
+	}
+
+	return generation, nil
+}
+
+// Load the checkpoint together with all its ancestors. The ancestors are found by following
+// the parent links left by CRIU.
+func (c *Container) LoadCheckpoint(target int) (Checkpoint, error) {
+	if ckpt, err := c.getCheckpoint(target); err == nil {
+		return ckpt, nil
+	}
+
+	ckptPath := c.PathAbs(CheckpointPath(c.ID(), target))
 	_, err := ioutil.ReadDir(ckptPath)
 	if err != nil {
 		log.WithError(err).WithField("dir", ckptPath).Error("Failed to open dir")
-		return err
+		return nil, err
+	}
+
+	parentGen, err := parentGeneration(ckptPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var parent Checkpoint
+	if parentGen != -1 {
+		// Generations only grow along a chain, otherwise the links form a cycle
+		if parentGen >= target {
+			return nil, fmt.Errorf("Checkpoint %v has a newer parent %v", target, parentGen)
+		}
+
+		parent, err = c.LoadCheckpoint(parentGen)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load parent of checkpoint %v: %v", target, err)
+		}
 	}
 
-	c.checkpoints = append(c.checkpoints, &checkpoint{
+	ckpt := &checkpoint{
 		generation: target,
 		container:  c,
-	})
+		parent:     parent,
+	}
+	c.checkpoints = append(c.checkpoints, ckpt)
 
-	return nil
+	return ckpt, nil
+}
+
+// Checkpoints of the chain ending with the checkpoint, the oldest ancestor first
+func Chain(checkpoint Checkpoint) []Checkpoint {
+	var chain []Checkpoint
+	for ckpt := checkpoint; ckpt != nil; ckpt = ckpt.Parent() {
+		chain = append([]Checkpoint{ckpt}, chain...)
+	}
+
+	return chain
 }
 
 func (c *checkpoint) Rank() Rank {
 	return c.container.Rank()
 }
 
+func (c *checkpoint) Parent() Checkpoint {
+	return c.parent
+}
+
 func (c *checkpoint) Generation() int {
 	return c.generation
 }
@@ -136,7 +272,36 @@ func (c *checkpoint) StatePath() string {
 }
 
 func (c *checkpoint) Path() string {
-	return path.Join(c.container.CheckpointsPath(), strconv.Itoa(c.Generation()))
+	return CheckpointPath(c.ContainerID(), c.Generation())
+}
+
+// The runc fork asks CRIU to track memory changes only for dumps with a parent. The first dump
+// of a chain enables the tracking through the CRIU configuration, otherwise the next dump of
+// the chain writes all pages again.
+const criuConfig = "track-mem\n"
+
+// Label, that makes runc pass the configuration file to CRIU
+const CriuConfigLabel = "org.criu.config"
+
+// Write the CRIU configuration of the containers into the nymph root. Returns the path to
+// the configuration file.
+func WriteCriuConfig(nymphRoot string) (string, error) {
+	configPath := path.Join(nymphRoot, "criu.conf")
+	if err := ioutil.WriteFile(configPath, []byte(criuConfig), 0644); err != nil {
+		return "", fmt.Errorf("Failed to write CRIU configuration: %v", err)
+	}
+
+	return configPath, nil
+}
+
+// Path to the directory with all checkpoints of a container starting from nymph root
+func ContainerCheckpointsPath(id string) string {
+	return path.Join(checkpointsDir, id)
+}
+
+// Path to a checkpoint directory of a container starting from nymph root
+func CheckpointPath(id string, generation int) string {
+	return path.Join(ContainerCheckpointsPath(id), strconv.Itoa(generation))
 }
 
 func (c *checkpoint) PathAbs() string {
@@ -144,17 +309,57 @@ func (c *checkpoint) PathAbs() string {
 }
 
 func (c *checkpoint) ImageInfo() *ImageInfoArgs {
+	parent := -1
+	if c.parent != nil {
+		parent = c.parent.Generation()
+	}
+
 	return &ImageInfoArgs{
 		Rank:       c.Rank(),
 		ID:         c.ContainerID(),
 		Args:       c.Args(),
 		Generation: c.generation,
+		Parent:     parent,
+
+		CheckpointInterval: c.container.CheckpointInterval(),
+		Init:               c.container.Init(),
+	}
+}
+
+// Stats are read from the file left by CRIU in the work directory
+func (c *checkpoint) Stats() (*DumpStats, error) {
+	buf, err := ioutil.ReadFile(path.Join(c.PathAbs(), "stats-dump"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip two magic values and the entry size
+	if len(buf) < 12 {
+		return nil, fmt.Errorf("Stats file is too short")
+	}
+
+	entry := &stats.StatsEntry{}
+	if err := proto.Unmarshal(buf[12:], entry); err != nil {
+		return nil, fmt.Errorf("Failed to parse stats: %v", err)
+	}
+
+	dump := entry.GetDump()
+	if dump == nil {
+		return nil, fmt.Errorf("No dump stats in checkpoint %v", c.generation)
 	}
+
+	return &DumpStats{
+		Generation:   c.generation,
+		PagesScanned: dump.GetPagesScanned(),
+		PagesWritten: dump.GetPagesWritten(),
+		FrozenTime:   time.Duration(dump.GetFrozenTime()) * time.Microsecond,
+	}, nil
 }
 
-func (c *checkpoint) Dump(preDump bool) error {
+func (c *checkpoint) Dump(opts DumpOpts) error {
 	criuOpts := &libcontainer.CriuOpts{
 		ImagesDirectory:   c.PathAbs(),
+		WorkDirectory:     c.PathAbs(),
 		LeaveRunning:      false,
 		TcpEstablished:    true,
 		ShellJob:          true,
@@ -162,13 +367,27 @@ func (c *checkpoint) Dump(preDump bool) error {
 		ManageCgroupsMode: libcontainer.CRIU_CG_MODE_SOFT,
 	}
 
-	if preDump {
+	if opts.PreDump {
 		criuOpts.LeaveRunning = true
 		criuOpts.PreDump = true
 	}
 
+	if opts.LeaveRunning {
+		criuOpts.LeaveRunning = true
+	}
+
+	if opts.PageServer != nil {
+		criuOpts.PageServer = *opts.PageServer
+	}
+
+	if opts.LazyPages {
+		criuOpts.LazyPages = true
+		criuOpts.StatusFd = opts.StatusFd
+	}
+
 	if c.parent != nil {
-		criuOpts.ParentImage = c.parent.PathAbs()
+		// Relative to the images directory, so that the chain can be copied elsewhere
+		criuOpts.ParentImage = path.Join("..", strconv.Itoa(c.parent.Generation()))
 	}
 
 	err := c.container.Checkpoint(criuOpts)
@@ -180,7 +399,7 @@ func (c *checkpoint) Dump(preDump bool) error {
 	return nil
 }
 
-func (c *checkpoint) Restore(process *libcontainer.Process) error {
+func (c *checkpoint) Restore(process *libcontainer.Process, opts RestoreOpts) error {
 	var parent string
 	if c.parent != nil {
 		parent = c.parent.PathAbs()
@@ -200,9 +419,16 @@ func (c *checkpoint) Restore(process *libcontainer.Process) error {
 		ManageCgroupsMode:       libcontainer.CRIU_CG_MODE_SOFT,
 	}
 
+	if opts.LazyPages {
+		// The lazy-pages daemon listens in the images directory
+		criuOpts.LazyPages = true
+		criuOpts.WorkDirectory = c.PathAbs()
+	}
+
 	log.WithFields(log.Fields{
 		"image":  criuOpts.ImagesDirectory,
 		"parent": criuOpts.ParentImage,
+		"lazy":   opts.LazyPages,
 	}).Debug("Restoring checkpoint")
 
 	err := c.container.Restore(process, criuOpts)
@@ -0,0 +1,103 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/opencontainers/runc/libcontainer"
+)
+
+// Only the ID of the container is needed to find its checkpoints
+type testLibcontainer struct {
+	libcontainer.Container
+}
+
+func (c *testLibcontainer) ID() string {
+	return "test"
+}
+
+// Container, whose nymph root is a temporary directory. The generations are created as
+// CRIU leaves them: each links to its parent, unless the parent is -1.
+func newTestContainer(t *testing.T, parents map[int]int) *Container {
+	root, err := ioutil.TempDir("", "konk-container")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cont, _ := newContainer(&testLibcontainer{}, 0, nil, root)
+	for generation, parent := range parents {
+		dir := cont.PathAbs(CheckpointPath(cont.ID(), generation))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if parent == -1 {
+			continue
+		}
+
+		if err := os.Symlink(path.Join("..", strconv.Itoa(parent)), path.Join(dir, parentLink)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return cont
+}
+
+func generations(checkpoints []Checkpoint) []int {
+	result := make([]int, 0, len(checkpoints))
+	for _, ckpt := range checkpoints {
+		result = append(result, ckpt.Generation())
+	}
+
+	return result
+}
+
+func TestLoadCheckpointWalksChain(t *testing.T) {
+	cont := newTestContainer(t, map[int]int{0: -1, 1: 0, 4: 1, 5: -1})
+	defer os.RemoveAll(cont.Base())
+
+	ckpt, err := cont.LoadCheckpoint(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chain := generations(Chain(ckpt)); !reflect.DeepEqual(chain, []int{0, 1, 4}) {
+		t.Errorf("Expected chain [0 1 4], got %v", chain)
+	}
+
+	// Another head of the same chain reuses the loaded ancestors
+	middle, err := cont.LoadCheckpoint(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if middle != ckpt.Parent() || len(cont.checkpoints) != 3 {
+		t.Errorf("Expected the loaded generations to be reused, know %v", generations(cont.checkpoints))
+	}
+
+	root, err := cont.LoadCheckpoint(5)
+	if err != nil || root.Parent() != nil {
+		t.Errorf("Expected generation 5 without parent, got %v, %v", root, err)
+	}
+}
+
+func TestLoadCheckpointBrokenChains(t *testing.T) {
+	for name, parents := range map[string]map[int]int{
+		"missing":        {},
+		"missing parent": {2: 1},
+		"self link":      {2: 2},
+		"cycle":          {1: 2, 2: 1},
+	} {
+		cont := newTestContainer(t, parents)
+		ckpt, err := cont.LoadCheckpoint(2)
+		os.RemoveAll(cont.Base())
+
+		if err == nil {
+			t.Errorf("%v: expected an error, got chain %v", name, generations(Chain(ckpt)))
+		}
+	}
+}
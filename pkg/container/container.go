@@ -10,6 +10,9 @@ import (
 	"net"
 	"os"
 	"path"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/opencontainers/runc/libcontainer"
 	"github.com/opencontainers/runc/libcontainer/utils"
@@ -25,6 +28,8 @@ type StartType int
 const (
 	Start StartType = iota
 	Restore
+	// Restore with memory pages fetched on demand
+	RestoreLazy
 )
 
 const (
@@ -34,6 +39,34 @@ const (
 	stateFilename  = "state.json"
 )
 
+// Exit status of the process running inside a container
+type ExitStatus struct {
+	Code   int
+	Signal syscall.Signal // Zero, if the process was not killed by a signal
+}
+
+func newExitStatus(state *os.ProcessState) ExitStatus {
+	if state == nil {
+		return ExitStatus{Code: -1}
+	}
+
+	waitStatus, ok := state.Sys().(syscall.WaitStatus)
+	if ok && waitStatus.Signaled() {
+		return ExitStatus{Code: -1, Signal: waitStatus.Signal()}
+	}
+
+	return ExitStatus{Code: state.ExitCode()}
+}
+
+// Exit code as a shell would report it
+func (e ExitStatus) ExitCode() int {
+	if e.Signal != 0 {
+		return 128 + int(e.Signal)
+	}
+
+	return e.Code
+}
+
 type Container struct {
 	libcontainer.Container
 	rank      Rank
@@ -44,6 +77,17 @@ type Container struct {
 
 	checkpoints      []Checkpoint
 	nextCheckpointId int
+	// Interval of periodic checkpoints, zero if they are disabled
+	checkpointInterval time.Duration
+	// The process runs as the init process of the container
+	init bool
+
+	// Closed, when the process inside the container finishes
+	exited       chan struct{}
+	exitStatus   ExitStatus
+	exitMigrated bool
+	migrating    bool
+	mutex        sync.Mutex
 }
 
 func newContainer(libCont libcontainer.Container, rank Rank, args []string, nymphRoot string) (*Container, error) {
@@ -54,6 +98,7 @@ func newContainer(libCont libcontainer.Container, rank Rank, args []string, nymp
 		args:             args,
 		checkpoints:      make([]Checkpoint, 0),
 		nextCheckpointId: 0,
+		exited:           make(chan struct{}),
 	}, nil
 }
 
@@ -65,8 +110,35 @@ func (c *Container) Args() []string {
 	return c.args
 }
 
+func (c *Container) CheckpointInterval() time.Duration {
+	return c.checkpointInterval
+}
+
+func (c *Container) SetCheckpointInterval(interval time.Duration) {
+	c.checkpointInterval = interval
+}
+
+// Whether the process was launched as the init process of the container
+func (c *Container) Init() bool {
+	return c.init
+}
+
+// Declare external resources for restore. The container can be restored several times,
+// so resources, that are known already, are skipped.
 func (c *Container) AddExternal(external []string) {
-	c.external = append(c.external, external...)
+	for _, ext := range external {
+		known := false
+		for _, cur := range c.external {
+			if cur == ext {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			c.external = append(c.external, ext)
+		}
+	}
 }
 
 func (c *Container) PathAbs(pathRel string) string {
@@ -90,7 +162,7 @@ func (c *Container) StatePathAbs() string {
 }
 
 func (c *Container) CheckpointsPath() string {
-	return path.Join(checkpointsDir, c.ID())
+	return ContainerCheckpointsPath(c.ID())
 }
 
 func (c *Container) Base() string {
@@ -154,7 +226,7 @@ func setupIO(process *libcontainer.Process, rootuid, rootgid int, detach bool, s
 	return t, nil
 }
 
-func (c *Container) latestCheckpoint() Checkpoint {
+func (c *Container) LatestCheckpoint() Checkpoint {
 	if len(c.checkpoints) < 1 {
 		return nil
 	}
@@ -172,8 +244,9 @@ func (c *Container) latestCheckpoint() Checkpoint {
 func (c *Container) Launch(startType StartType, args []string, init bool) error {
 	process, err := c.NewProcess(args, init)
 	if err != nil {
-		return fmt.Errorf("Failed to create new process", err)
+		return fmt.Errorf("Failed to create new process: %v", err)
 	}
+	c.init = init
 
 	rootuid, err := c.Config().HostRootUID()
 	if err != nil {
@@ -188,7 +261,7 @@ func (c *Container) Launch(startType StartType, args []string, init bool) error
 	sockpath := ""
 	c.tty, err = setupIO(process, rootuid, rootgid, detach, sockpath)
 	if err != nil {
-		return fmt.Errorf("Failed to setup IO", err)
+		return fmt.Errorf("Failed to setup IO: %v", err)
 	}
 
 	log.WithFields(log.Fields{
@@ -203,15 +276,17 @@ func (c *Container) Launch(startType StartType, args []string, init bool) error
 			log.WithFields(log.Fields{
 				"process": process,
 			}).WithError(err).Error("Failed to launch container in a process")
-			return fmt.Errorf("Failed to launch container in a process", err)
+			return fmt.Errorf("Failed to launch container in a process: %v", err)
 		}
-	case Restore:
-		checkpoint := c.latestCheckpoint()
+	case Restore, RestoreLazy:
+		checkpoint := c.LatestCheckpoint()
 		if checkpoint == nil {
 			return fmt.Errorf("No checkpoint")
 		}
 
-		err = checkpoint.Restore(process)
+		err = checkpoint.Restore(process, RestoreOpts{
+			LazyPages: startType == RestoreLazy,
+		})
 		if err != nil {
 			log.WithFields(log.Fields{
 				"ckpt":  checkpoint.PathAbs(),
@@ -222,18 +297,82 @@ func (c *Container) Launch(startType StartType, args []string, init bool) error
 		}
 	}
 
+	c.mutex.Lock()
+	exited := c.exited
+	c.mutex.Unlock()
+
 	go func() {
 		ret, err := process.Wait()
 		if err != nil {
-			log.Error("Waiting for process failed", err)
+			log.WithError(err).Error("Waiting for process failed")
 		}
 
 		log.WithField("return", ret).Trace("Finished process")
+
+		c.mutex.Lock()
+		c.exitStatus = newExitStatus(ret)
+		c.exitMigrated = c.migrating
+		c.mutex.Unlock()
+
+		close(exited)
 	}()
 
 	return nil
 }
 
+// Restore the process from the latest checkpoint after the process was dumped for a
+// migration, that has failed. Waiters of the dumped process are told, that it has migrated,
+// and are expected to find the process here again.
+func (c *Container) Rollback() error {
+	c.mutex.Lock()
+	exited := c.exited
+	c.mutex.Unlock()
+
+	// The dumped process must be gone, before it can be restored
+	<-exited
+
+	c.mutex.Lock()
+	c.exited = make(chan struct{})
+	c.migrating = false
+	c.mutex.Unlock()
+
+	return c.Launch(Restore, c.Args(), c.Init())
+}
+
+// Check, if the process inside the container is not running anymore
+func (c *Container) Stopped() bool {
+	status, err := c.Status()
+	if err != nil {
+		return false
+	}
+
+	return status == libcontainer.Stopped
+}
+
+// Mark the container as being migrated away. If the process exits while the flag
+// is set, waiters are told to look for the container at another nymph.
+func (c *Container) SetMigrating(migrating bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.migrating = migrating
+}
+
+// Block until the process inside the container exits. Returns the exit status and
+// true, if the process was stopped because the container migrated.
+func (c *Container) Wait() (ExitStatus, bool) {
+	c.mutex.Lock()
+	exited := c.exited
+	c.mutex.Unlock()
+
+	<-exited
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.exitStatus, c.exitMigrated
+}
+
 func (c *Container) Destroy() (err error) {
 	log.WithField("rank", c.Rank()).Debug("Destroying container")
 
@@ -67,6 +67,26 @@ func (c *ContainerRegister) GetUnlocked(rank Rank) (*Container, error) {
 	return nil, fmt.Errorf("Container %v not found", rank)
 }
 
+func (c *ContainerRegister) Get(rank Rank) (*Container, error) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	return c.GetUnlocked(rank)
+}
+
+// Ranks of all registered containers
+func (c *ContainerRegister) Ranks() []Rank {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	ranks := make([]Rank, 0, len(c.reg))
+	for rank := range c.reg {
+		ranks = append(ranks, rank)
+	}
+
+	return ranks
+}
+
 func (c *ContainerRegister) GetOrCreate(rank Rank, name string, args []string, config *configs.Config) (*Container, error) {
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
@@ -115,7 +135,7 @@ func (c *ContainerRegister) Load(imageInfo ImageInfoArgs) (*Container, error) {
 
 	libCont, err := c.Factory.Load(imageInfo.ID)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to lead a libcontainer", err)
+		return nil, fmt.Errorf("Failed to lead a libcontainer: %v", err)
 	}
 
 	cont, err = newContainer(libCont, imageInfo.Rank, imageInfo.Args, c.NymphDir)
@@ -123,17 +143,18 @@ func (c *ContainerRegister) Load(imageInfo ImageInfoArgs) (*Container, error) {
 		return nil, err
 	}
 
-	if err := cont.LoadCheckpoint(imageInfo.Generation); err != nil {
+	checkpoint, err := cont.LoadCheckpoint(imageInfo.Generation)
+	if err != nil {
 		return nil, err
 	}
 
-	if imageInfo.Parent != -1 {
-		if err := cont.LoadCheckpoint(imageInfo.Parent); err != nil {
-			return nil, err
-		}
+	if parent := checkpoint.ImageInfo().Parent; parent != imageInfo.Parent {
+		return nil, fmt.Errorf("Checkpoint %v has parent %v, expected %v", imageInfo.Generation, parent, imageInfo.Parent)
 	}
 
 	cont.nextCheckpointId = imageInfo.Generation + 1
+	cont.checkpointInterval = imageInfo.CheckpointInterval
+	cont.init = imageInfo.Init
 
 	// Remember container
 	c.reg[imageInfo.Rank] = cont
@@ -160,15 +181,31 @@ func (c *ContainerRegister) DeleteUnlocked(rank Rank) {
 	delete(c.reg, rank)
 }
 
+// Destroy the container and forget about it, but only if the register still knows
+// this particular container under its rank. Returns false, if the container has already
+// been deleted or replaced.
+func (c *ContainerRegister) Delete(cont *Container) bool {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if cur, ok := c.reg[cont.Rank()]; !ok || cur != cont {
+		return false
+	}
+
+	c.DeleteUnlocked(cont.Rank())
+	return true
+}
+
 func (c *ContainerRegister) Destroy() {
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
-	for _, cont := range c.reg {
+	for rank, cont := range c.reg {
 		if err := cont.Destroy(); err != nil {
 			log.WithError(err).WithFields(log.Fields{
 				"rank": cont.Rank(),
 				"id":   cont.ID(),
 			}).Error("Destroying failed")
 		}
+		delete(c.reg, rank)
 	}
 }
@@ -0,0 +1,80 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Remove generation directories in the directory, except the listed ones. Other files are left
+// untouched. Returns the removed generations.
+func RemoveGenerations(dir string, keep []int) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	live := make(map[int]bool)
+	for _, generation := range keep {
+		live[generation] = true
+	}
+
+	var removed []int
+	for _, file := range files {
+		generation, err := strconv.Atoi(file.Name())
+		if err != nil || !file.IsDir() || live[generation] {
+			continue
+		}
+
+		if err := os.RemoveAll(path.Join(dir, file.Name())); err != nil {
+			return removed, err
+		}
+		removed = append(removed, generation)
+	}
+
+	return removed, nil
+}
+
+// Keep the heads together with their ancestors and remove all other checkpoints of the
+// container. Directories of generations, that the container does not know about, are removed
+// as well. Without heads, all checkpoints are removed. Returns the removed generations.
+func (c *Container) CollectCheckpoints(heads ...Checkpoint) []int {
+	live := make(map[int]bool)
+	var keep []int
+	for _, head := range heads {
+		for _, ckpt := range Chain(head) {
+			if !live[ckpt.Generation()] {
+				live[ckpt.Generation()] = true
+				keep = append(keep, ckpt.Generation())
+			}
+		}
+	}
+
+	var checkpoints []Checkpoint
+	for _, ckpt := range c.checkpoints {
+		if live[ckpt.Generation()] {
+			checkpoints = append(checkpoints, ckpt)
+		}
+	}
+	c.checkpoints = checkpoints
+
+	removed, err := RemoveGenerations(c.PathAbs(c.CheckpointsPath()), keep)
+	if err != nil {
+		log.WithError(err).WithField("rank", c.Rank()).Warn("Failed to remove checkpoints")
+	}
+
+	if len(removed) > 0 {
+		log.WithFields(log.Fields{
+			"rank":    c.Rank(),
+			"removed": removed,
+			"kept":    keep,
+		}).Debug("Collected checkpoints")
+	}
+
+	return removed
+}
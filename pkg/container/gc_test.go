@@ -0,0 +1,104 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func listDir(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func TestRemoveGenerations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "konk-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"0", "1", "2", "3", "tmp"} {
+		if err := os.MkdirAll(path.Join(dir, name, "images"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only directories named by a generation are removed
+	for _, name := range []string{"4", "state.json"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := RemoveGenerations(dir, []int{1, 3, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Ints(removed)
+	if !reflect.DeepEqual(removed, []int{0, 2}) {
+		t.Errorf("Expected to remove [0 2], removed %v", removed)
+	}
+
+	if names := listDir(t, dir); !reflect.DeepEqual(names, []string{"1", "3", "4", "state.json", "tmp"}) {
+		t.Errorf("Unexpected directory contents %v", names)
+	}
+
+	if removed, err := RemoveGenerations(path.Join(dir, "missing"), nil); err != nil || removed != nil {
+		t.Errorf("Missing directory has nothing to remove, got %v, %v", removed, err)
+	}
+}
+
+func TestCollectCheckpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		parents map[int]int
+		heads   []int
+		kept    []string
+	}{
+		{"no heads", map[int]int{0: -1, 1: 0}, nil, []string{}},
+		{"ancestors of the head", map[int]int{0: -1, 1: 0, 2: 1, 3: -1}, []int{2}, []string{"0", "1", "2"}},
+		{"previous chain", map[int]int{0: -1, 1: 0, 2: -1, 3: 2}, []int{1, 3}, []string{"0", "1", "2", "3"}},
+		{"other branch", map[int]int{0: -1, 1: 0, 2: 0, 3: 1}, []int{2}, []string{"0", "2"}},
+	}
+
+	for _, test := range tests {
+		cont := newTestContainer(t, test.parents)
+
+		var heads []Checkpoint
+		for _, generation := range test.heads {
+			head, err := cont.LoadCheckpoint(generation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			heads = append(heads, head)
+		}
+
+		cont.CollectCheckpoints(heads...)
+		kept := listDir(t, cont.PathAbs(cont.CheckpointsPath()))
+		known := generations(cont.checkpoints)
+		os.RemoveAll(cont.Base())
+
+		if !reflect.DeepEqual(kept, test.kept) {
+			t.Errorf("%v: expected %v to be kept, got %v", test.name, test.kept, kept)
+		}
+
+		if len(known) != len(test.kept) {
+			t.Errorf("%v: container still knows %v", test.name, known)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Content hashes of the files of a checkpoint. Keys are file names relative to the nymph
+// root, values are hex encoded SHA-256 hashes. For symbolic links the link target is hashed.
+// Memory pages, that CRIU sends through a page server or serves lazily, never pass the donor
+// and are not part of the manifest.
+type Manifest map[string]string
+
+// Hash of the whole manifest, that does not depend on the order of files
+func (m Manifest) Hash() string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s %s\n", name, m[name])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Compare the manifest of received files with the expected one. Returns an error naming
+// the first file, that does not match.
+func (m Manifest) Verify(expected Manifest) error {
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		got, ok := m[name]
+		if !ok {
+			return fmt.Errorf("File %s has not been received", name)
+		}
+
+		if got != expected[name] {
+			return fmt.Errorf("File %s is corrupted: expected hash %s, got %s", name, expected[name], got)
+		}
+	}
+
+	for name := range m {
+		if _, ok := expected[name]; !ok {
+			return fmt.Errorf("File %s is not part of the checkpoint", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package container
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestManifestHashIgnoresOrder(t *testing.T) {
+	a := Manifest{"pages-1.img": "1", "core-1.img": "2"}
+	b := Manifest{"core-1.img": "2", "pages-1.img": "1"}
+
+	if a.Hash() != b.Hash() {
+		t.Errorf("Hash depends on the order of files")
+	}
+
+	for _, other := range []Manifest{
+		{"pages-1.img": "1", "core-1.img": "3"},
+		{"pages-1.img": "1", "core-2.img": "2"},
+		{"pages-1.img": "1"},
+		{"pages-1.img": "1 core-1.img", "": "2"},
+	} {
+		if other.Hash() == a.Hash() {
+			t.Errorf("Manifest %v has the hash of %v", other, a)
+		}
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	expected := Manifest{"pages-1.img": "1", "core-1.img": "2"}
+
+	if err := (Manifest{"core-1.img": "2", "pages-1.img": "1"}).Verify(expected); err != nil {
+		t.Errorf("Matching manifest rejected: %v", err)
+	}
+
+	errors := map[string]Manifest{
+		"has not been received":         {"pages-1.img": "1"},
+		"is corrupted":                  {"pages-1.img": "1", "core-1.img": "3"},
+		"is not part of the checkpoint": {"pages-1.img": "1", "core-1.img": "2", "extra": "3"},
+	}
+
+	for message, received := range errors {
+		err := received.Verify(expected)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected an error, that the file %v, got %v", message, err)
+		}
+	}
+}
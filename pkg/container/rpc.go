@@ -15,9 +15,48 @@ type ImageInfoArgs struct {
 	Args       []string
 	Generation int // Checkpoint generation number
 	Parent     int // Parent checkpoint generation number
+	// Interval of periodic checkpoints, zero if they are disabled
+	CheckpointInterval time.Duration
+	// The process runs as the init process of the container
+	Init bool
+}
+
+// Every request of a migration refers to the transfer session at the recipient, so that
+// a donor can reconnect and resume an interrupted transfer.
+type OpenSessionArgs struct {
+	Session string
+}
+
+// What the recipient has received in a session so far
+type SessionState struct {
+	// Set, if the transfer of a checkpoint has started
+	HasImage bool
+	Image    ImageInfoArgs
+	Files    map[string]FileState
+	// Set, if the container has been relaunched at the recipient
+	Relaunched bool
+}
+
+type FileState struct {
+	Handle   int
+	Complete bool
+	Chunks   []int64 // Offsets of the chunks, that have been written
+}
+
+type CloseSessionArgs struct {
+	Session string
+	// Remove files received in the session, because the migration did not finish
+	Discard bool
+}
+
+// Starts the transfer of a checkpoint
+type CheckpointInfoArgs struct {
+	Session string
+	Image   ImageInfoArgs
 }
 
 type LinkInfoArgs struct {
+	Session  string
 	Filename string
 	Link     string
 	Size     int64
@@ -26,15 +65,59 @@ type LinkInfoArgs struct {
 }
 
 type FileInfoArgs struct {
-	Filename string
-	Size     int64
-	Mode     os.FileMode
-	ModTime  time.Time
+	Session     string
+	Filename    string
+	Size        int64 // Size of the file before compression
+	Mode        os.FileMode
+	ModTime     time.Time
+	Compression string // Compression of the data chunks
+}
+
+// Compressions the donor can use, in the order of preference
+type NegotiateArgs struct {
+	Compressions []string
 }
 
 type FileDataArgs struct {
-	Data []byte
+	Session string
+	Handle  int   // Handle of the file returned by the recipient
+	Offset  int64 // Offset of the chunk in the uncompressed file
+	Data    []byte
+}
+
+// Asks the recipient for the port, that accepts data channels
+type DataPortArgs struct {
+}
+
+// Sent after all files of a checkpoint, so that the recipient can verify them
+type ManifestArgs struct {
+	Session string
+	Files   Manifest
+	Hash    string // Hash of the whole manifest
 }
 
 type RelaunchArgs struct {
+	Session string
+	// ID of the migration at the coordinator, if it is tracked there
+	MigrationID uint64
+	// If set, the memory pages are served lazily by the donor at the given address
+	LazyPagesAddress string
+	LazyPagesPort    int
+}
+
+type PageServerArgs struct {
+	Session    string
+	ID         string
+	Generation int
+	Parent     int // Generation of the parent checkpoint, or -1
+}
+
+type PageServerReply struct {
+	Port int
+}
+
+type FinishPageServerArgs struct {
+	Session string
+	// Do not wait for the dump, kill the page server right away
+	Abort bool
 }
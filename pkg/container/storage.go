@@ -0,0 +1,92 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Layout of a checkpoint kept in a storage directory outside of the nymph root
+const (
+	storedInfoFilename = "checkpoint.json"
+	storedImagesDir    = "images"
+)
+
+// Description of a checkpoint in a storage directory. The image info is enough to load the
+// container again at any nymph, once the state file and the images of the generation and
+// of its ancestors are put in place.
+type StoredCheckpoint struct {
+	Image    ImageInfoArgs
+	Stats    DumpStats
+	Hostname string
+	Created  time.Time
+}
+
+// Path to the state file of a container starting from nymph root
+func ContainerStatePath(id string) string {
+	return path.Join(containersDir, factoryDir, id, stateFilename)
+}
+
+// Path to the state file of the container in a storage directory
+func StoredStatePath(dir string) string {
+	return path.Join(dir, stateFilename)
+}
+
+// Path to the images of all generations in a storage directory. Like in the nymph root,
+// each generation has its own directory, and generations link to their parents.
+func StoredCheckpointsPath(dir string) string {
+	return path.Join(dir, storedImagesDir)
+}
+
+// Path to the images of a generation in a storage directory
+func StoredImagesPath(dir string, generation int) string {
+	return path.Join(dir, storedImagesDir, strconv.Itoa(generation))
+}
+
+func storedInfoPath(dir string) string {
+	return path.Join(dir, storedInfoFilename)
+}
+
+// Check, if the directory holds a stored checkpoint already
+func IsStoredCheckpoint(dir string) bool {
+	_, err := os.Stat(storedInfoPath(dir))
+	return err == nil
+}
+
+// Write the description of the checkpoint. It is written last, so that only complete
+// checkpoints are described.
+func SaveStoredCheckpoint(dir string, stored *StoredCheckpoint) error {
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := storedInfoPath(dir) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0660); err != nil {
+		return fmt.Errorf("Failed to write %v: %v", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, storedInfoPath(dir)); err != nil {
+		return fmt.Errorf("Failed to write checkpoint description: %v", err)
+	}
+
+	return nil
+}
+
+func LoadStoredCheckpoint(dir string) (*StoredCheckpoint, error) {
+	data, err := ioutil.ReadFile(storedInfoPath(dir))
+	if err != nil {
+		return nil, fmt.Errorf("No checkpoint found in %v: %v", dir, err)
+	}
+
+	stored := &StoredCheckpoint{}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, fmt.Errorf("Failed to parse checkpoint description: %v", err)
+	}
+
+	return stored, nil
+}
@@ -39,7 +39,7 @@ func CreateContainerAddr(rank Rank) *netlink.Addr {
 	base.IP = base.IP.To4()
 	base.IP[2] = 1
 	if rank > 253 {
-		log.Panic("Unsupported container rank: %v", rank)
+		log.Panicf("Unsupported container rank: %v", rank)
 	}
 	base.IP[3] = byte(rank + 1)
 
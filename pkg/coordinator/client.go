@@ -24,7 +24,7 @@ func NewClient() (*Client, error) {
 
 	rpcClient, err := util.DialRpcServer(hostname, port)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to dial %v: %v", err)
+		return nil, fmt.Errorf("Failed to dial %v:%v: %v", hostname, port, err)
 	}
 
 	return &Client{
@@ -32,6 +32,33 @@ func NewClient() (*Client, error) {
 	}, nil
 }
 
+// Create new connection to the coordinator, but do not retry, if the coordinator is not
+// reachable
+func NewClientOnce() (*Client, error) {
+	hostname := config.GetString(config.CoordinatorHost)
+	port := config.GetInt(config.CoordinatorPort)
+
+	rpcClient, err := util.DialRpcServerOnce(hostname, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		client: rpcClient,
+	}, nil
+}
+
+// Check, if a call failed, because the connection to the coordinator is gone. Errors
+// returned by the coordinator itself leave the connection usable.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(rpc.ServerError)
+	return !ok
+}
+
 // The container-process tells the coordinator its container rank, and address to connect
 func (c *Client) AllocateHost(rank container.Rank) (string, error) {
 	args := &AllocateHostArgs{
@@ -44,6 +71,18 @@ func (c *Client) AllocateHost(rank container.Rank) (string, error) {
 	return hostname, err
 }
 
+// Ask the coordinator, where the container is running now
+func (c *Client) LocateContainer(rank container.Rank) (string, error) {
+	args := &LocateContainerArgs{
+		Rank: rank,
+	}
+
+	var hostname string
+	err := c.client.Call(rpcLocateContainer, args, &hostname)
+
+	return hostname, err
+}
+
 // The container-process tells the coordinator its container rank, and address to connect
 func (c *Client) RegisterContainer(rank container.Rank, hostname string) error {
 	args := &RegisterContainerArgs{rank, hostname}
@@ -71,32 +110,118 @@ func (c *Client) UnregisterContainer(rank container.Rank) error {
 }
 
 // Request the coordinator to coordinate migration of a process to another node
-func (c *Client) Migrate(rank container.Rank, destHost string, migrationType container.MigrationType) error {
-	args := &MigrateArgs{rank, destHost, migrationType}
+func (c *Client) Migrate(rank container.Rank, destHost string, migrationType container.MigrationType, opts container.MigrationOpts) (*MigrateReply, error) {
+	return c.migrate(&MigrateArgs{
+		Rank:          rank,
+		DestHost:      destHost,
+		MigrationType: migrationType,
+		Opts:          opts,
+	})
+}
 
+// Queue a migration without waiting for it. Returns the ID of the migration.
+func (c *Client) StartMigration(rank container.Rank, destHost string, migrationType container.MigrationType, opts container.MigrationOpts) (uint64, error) {
+	reply, err := c.migrate(&MigrateArgs{
+		Rank:          rank,
+		DestHost:      destHost,
+		MigrationType: migrationType,
+		Opts:          opts,
+		Detach:        true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return reply.ID, nil
+}
+
+func (c *Client) migrate(args *MigrateArgs) (*MigrateReply, error) {
 	log.Println(args)
-	var reply bool
+	var reply MigrateReply
 	err := c.client.Call(rpcMigrate, args, &reply)
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	return &reply, nil
 }
 
-// Send signal to all registered containers via nymphs
+// Migrate a batch of ranks. Returns the outcome of every rank of the batch.
+func (c *Client) MigrateBatch(args *MigrateBatchArgs) ([]RankOutcome, error) {
+	var reply MigrateBatchReply
+	err := c.client.Call(rpcMigrateBatch, args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Outcomes, nil
+}
+
+func (c *Client) MigrationStatus(id uint64) (*MigrationStatus, error) {
+	args := &MigrationStatusArgs{id}
+
+	var reply MigrationStatus
+	err := c.client.Call(rpcMigrationStatus, args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reply, nil
+}
+
+// List running and queued migrations, and with all also the recently finished ones
+func (c *Client) ListMigrations(all bool) ([]MigrationStatus, error) {
+	args := &ListMigrationsArgs{all}
+
+	var reply []MigrationStatus
+	err := c.client.Call(rpcListMigrations, args, &reply)
+
+	return reply, err
+}
+
+// Report the progress of a migration. Called by the nymphs taking part in it.
+func (c *Client) MigrationProgress(args *MigrationProgressArgs) error {
+	var reply bool
+	return c.client.Call(rpcMigrationProgress, args, &reply)
+}
+
+// Report the latest good checkpoint of a rank. Called by the nymph, that took it.
+func (c *Client) ReportCheckpoint(args *ReportCheckpointArgs) error {
+	var reply bool
+	return c.client.Call(rpcReportCheckpoint, args, &reply)
+}
+
+// Ranks, that the nymph must destroy, because the coordinator has restarted them elsewhere
+func (c *Client) FencedContainers(hostname string) ([]container.Rank, error) {
+	args := &FencedContainersArgs{hostname}
+
+	var reply []container.Rank
+	err := c.client.Call(rpcFencedContainers, args, &reply)
+
+	return reply, err
+}
+
+// Send signal to registered containers via nymphs. If no ranks are given, all
+// registered containers receive the signal.
 //
 // XXX: This break single responsibility principle, because migrate and signal interfaces
 // are independent, but as long as it is just a single call, it is OK
-func (c *Client) Signal(signal syscall.Signal) error {
-	args := &SignalArgs{signal}
+func (c *Client) Signal(signal syscall.Signal, ranks ...container.Rank) error {
+	args := &SignalArgs{signal, ranks}
 
-	log.Println("Sending signal", signal)
+	log.Println("Sending signal", signal, ranks)
 	var reply bool
 	err := c.client.Call(rpcSignal, args, &reply)
 
 	return err
 }
 
-func (c *Client) RegisterNymph(hostname string) (uint, error) {
-	args := &RegisterNymphArgs{hostname}
+// Register the nymph. A fresh nymph has lost the replicas, that it held before.
+func (c *Client) RegisterNymph(hostname string, fresh bool) (uint, error) {
+	args := &RegisterNymphArgs{
+		Hostname: hostname,
+		Fresh:    fresh,
+	}
 
 	log.Println("Registering nymph ", hostname)
 	var reply uint
@@ -115,6 +240,16 @@ func (c *Client) UnregisterNymph(hostname string) error {
 	return err
 }
 
+// Tell the coordinator that the nymph is still alive and what resources it has
+func (c *Client) Heartbeat(hostname string, metrics NymphMetrics) error {
+	args := &HeartbeatArgs{hostname, metrics}
+
+	var reply bool
+	err := c.client.Call(rpcHeartbeat, args, &reply)
+
+	return err
+}
+
 func (c *Client) Close() {
 	c.client.Close()
 }
@@ -2,6 +2,7 @@ package coordinator
 
 import (
 	"syscall"
+	"time"
 
 	"github.com/planetA/konk/pkg/container"
 )
@@ -9,21 +10,35 @@ import (
 // RPC method names
 
 const (
-	rpcAllocateHost   = "Coordinator.AllocateHost"
+	rpcAllocateHost    = "Coordinator.AllocateHost"
+	rpcLocateContainer = "Coordinator.LocateContainer"
 
 	rpcRegisterContainer   = "Coordinator.RegisterContainer"
 	rpcUnregisterContainer = "Coordinator.UnregisterContainer"
 	rpcMigrate             = "Coordinator.Migrate"
+	rpcMigrateBatch        = "Coordinator.MigrateBatch"
 	rpcSignal              = "Coordinator.Signal"
 
+	rpcMigrationStatus   = "Coordinator.MigrationStatus"
+	rpcListMigrations    = "Coordinator.ListMigrations"
+	rpcMigrationProgress = "Coordinator.MigrationProgress"
+
+	rpcReportCheckpoint = "Coordinator.ReportCheckpoint"
+	rpcFencedContainers = "Coordinator.FencedContainers"
+
 	rpcRegisterNymph   = "Coordinator.RegisterNymph"
 	rpcUnregisterNymph = "Coordinator.UnregisterNymph"
+	rpcHeartbeat       = "Coordinator.Heartbeat"
 )
 
 type AllocateHostArgs struct {
 	Rank container.Rank
 }
 
+type LocateContainerArgs struct {
+	Rank container.Rank
+}
+
 type RegisterContainerArgs struct {
 	Rank     container.Rank
 	Hostname string
@@ -38,16 +53,167 @@ type MigrateArgs struct {
 	Rank          container.Rank
 	DestHost      string
 	MigrationType container.MigrationType
+	Opts          container.MigrationOpts
+	// Return right after the migration has been queued, instead of waiting for it
+	Detach bool
+}
+
+type MigrateReply struct {
+	// ID to ask for the status of the migration
+	ID uint64
+	// Statistics of every dump made during the migration
+	Dumps []container.DumpStats
+	// The migration failed, but the container keeps running at the source
+	RolledBack bool
+	// Reason of the rollback
+	Error string
+	// Memory pages went through a page server and are not covered by the manifest
+	PagesUnverified bool
+}
+
+// Destination of a rank in a batch migration
+type RankMove struct {
+	Rank     container.Rank
+	DestHost string
+}
+
+// Migrate many ranks at once. The ranks either go to explicit destinations, or all ranks
+// leave the evacuated host for other nymphs chosen by the coordinator.
+type MigrateBatchArgs struct {
+	Moves         []RankMove
+	Evacuate      string
+	MigrationType container.MigrationType
+	Opts          container.MigrationOpts
+	// Number of ranks of the batch migrating at the same time, 0 for no limit besides the
+	// concurrency of the coordinator
+	Parallel int
+}
+
+// Result of the migration of a rank in a batch
+type RankOutcome struct {
+	Rank container.Rank
+	Src  string
+	Dest string
+	// Zero, if the migration has not been started
+	MigrationID uint64
+	// Done, failed or rolled back
+	Outcome MigrationPhase
+	Error   string
+}
+
+type MigrateBatchReply struct {
+	Outcomes []RankOutcome
+}
+
+type MigrationPhase string
+
+const (
+	PhaseQueued     MigrationPhase = "queued"
+	PhasePreDump    MigrationPhase = "pre-dump"
+	PhaseDump       MigrationPhase = "dump"
+	PhaseTransfer   MigrationPhase = "transfer"
+	PhaseRestore    MigrationPhase = "restore"
+	PhaseNetwork    MigrationPhase = "network"
+	PhaseDone       MigrationPhase = "done"
+	PhaseFailed     MigrationPhase = "failed"
+	PhaseRolledBack MigrationPhase = "rolled-back"
+)
+
+// Check, if the migration has ended in the phase
+func (p MigrationPhase) Final() bool {
+	return p == PhaseDone || p == PhaseFailed || p == PhaseRolledBack
+}
+
+// Time spent in a phase. A phase can be entered several times, e.g., pre-dump and
+// transfer alternate during an iterative pre-dump.
+type PhaseTiming struct {
+	Phase   MigrationPhase
+	Start   time.Time
+	Elapsed time.Duration
+}
+
+type MigrationStatus struct {
+	ID            uint64
+	Rank          container.Rank
+	Src           string
+	Dest          string
+	MigrationType container.MigrationType
+	Phase         MigrationPhase
+	Phases        []PhaseTiming
+	// Checkpoint data transferred and to be transferred in total
+	BytesSent  int64
+	BytesTotal int64
+	Submitted  time.Time
+	Error      string
+}
+
+type MigrationStatusArgs struct {
+	ID uint64
+}
+
+type ListMigrationsArgs struct {
+	// Include finished migrations
+	All bool
+}
+
+// Sent by the nymphs, as the migration advances
+type MigrationProgressArgs struct {
+	ID         uint64
+	Phase      MigrationPhase
+	BytesSent  int64
+	BytesTotal int64
+}
+
+// Sent by the nymphs after every periodic checkpoint of a rank
+type ReportCheckpointArgs struct {
+	Rank     container.Rank
+	Hostname string
+	Image    container.ImageInfoArgs
+	// Storage directory holding the checkpoint, empty if the checkpoint is kept only at
+	// the nymph
+	Dir string
+	// Buddy nymphs holding a replica of the checkpoint
+	Replicas []string
+	Created  time.Time
+}
+
+// Asked by a nymph, that registers again, which of its containers have been restarted
+// elsewhere in the meantime
+type FencedContainersArgs struct {
+	Hostname string
 }
 
 type SignalArgs struct {
 	Signal syscall.Signal
+	Ranks  []container.Rank // If empty, signal all ranks
 }
 
 type RegisterNymphArgs struct {
 	Hostname string
+	// The nymph has started with an empty root directory, so it holds no replicas
+	Fresh bool
 }
 
 type UnregisterNymphArgs struct {
 	Hostname string
 }
+
+// Resource usage of a container
+type ContainerMetrics struct {
+	Rank        container.Rank
+	MemoryUsage uint64 // In bytes
+}
+
+// Resources of a node, as reported by its nymph
+type NymphMetrics struct {
+	CpuCount    int
+	Load1       float64
+	MemoryFree  uint64 // Available memory in bytes
+	MemoryTotal uint64
+	Containers  []ContainerMetrics
+}
+
+type HeartbeatArgs struct {
+	Hostname string
+	Metrics  NymphMetrics
+}
@@ -109,7 +109,7 @@ func Run(image string, args []string) error {
 	containerConfig := &configs.Config{}
 	container, err := containerFactory.Create("mpirun", containerConfig)
 	if err != nil {
-		return fmt.Errorf("Creating container failed", err)
+		return fmt.Errorf("Creating container failed: %v", err)
 	}
 	defer container.Destroy()
 
@@ -130,7 +130,7 @@ func Run(image string, args []string) error {
 
 	// Wait until command ends
 	if err := container.Run(process); err != nil {
-		log.Println("MPI terminated with an error: %v", err)
+		log.Printf("MPI terminated with an error: %v", err)
 		return fmt.Errorf("MPI terminated with an error: %v", err)
 	}
 
@@ -229,7 +229,7 @@ func vethPortRank(state *specs.State) (container.Rank, error) {
 
 	val, err := strconv.Atoi(rank)
 	if err != nil {
-		return -1, fmt.Errorf("Invalid rank: v", rank)
+		return -1, fmt.Errorf("Invalid rank: %v", rank)
 	}
 
 	return container.Rank(val), nil
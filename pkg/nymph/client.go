@@ -4,7 +4,6 @@ package nymph
 import (
 	"fmt"
 	"net/rpc"
-	"os"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
@@ -36,18 +35,37 @@ func NewClient(hostname string) (*Client, error) {
 	}, nil
 }
 
+// Create new connection to a node daemon, but do not retry, if the nymph is not reachable
+func NewClientOnce(hostname string) (*Client, error) {
+	port := config.GetInt(config.NymphPort)
+	rpcClient, err := util.DialRpcServerOnce(hostname, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		client: rpcClient,
+	}, nil
+}
+
 // Send the checkpoint to the server at given host and port. The receiver is a nymph, but the
 // port is supposed to be not the default nymph port.
-func (c *Client) Send(containerRank container.Rank, destHost string, migrationType container.MigrationType) error {
-	args := &SendArgs{containerRank, destHost, migrationType}
+func (c *Client) Send(migrationID uint64, containerRank container.Rank, destHost string, migrationType container.MigrationType, opts container.MigrationOpts) (*SendReply, error) {
+	args := &SendArgs{
+		MigrationID:   migrationID,
+		ContainerRank: containerRank,
+		Host:          destHost,
+		MigrationType: migrationType,
+		Opts:          opts,
+	}
 
-	var reply bool
+	var reply SendReply
 	err := c.client.Call(rpcSend, args, &reply)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &reply, nil
 }
 
 func (c *Client) Signal(containerRank container.Rank, signal syscall.Signal) error {
@@ -73,8 +91,88 @@ func (c *Client) Run(runArgs *RunArgs) error {
 	return nil
 }
 
-func (c *Client) Wait(containerRank container.Rank) (os.ProcessState, error) {
-	return os.ProcessState{}, nil
+// Block until the process inside the container exits. If the container has migrated
+// away from the nymph, the reply has Migrated flag set and the caller should ask the
+// coordinator about the new location.
+func (c *Client) Wait(containerRank container.Rank) (*WaitReply, error) {
+	args := &WaitArgs{containerRank}
+
+	log.WithField("container", containerRank).Trace("Waiting for container")
+	var reply WaitReply
+	if err := c.client.Call(rpcWait, args, &reply); err != nil {
+		return nil, fmt.Errorf("RPC call failed: %v", err)
+	}
+
+	return &reply, nil
+}
+
+// Return ranks of all containers running at the nymph
+func (c *Client) ListContainers() ([]container.Rank, error) {
+	args := &ListContainersArgs{}
+
+	var reply []container.Rank
+	if err := c.client.Call(rpcListContainers, args, &reply); err != nil {
+		return nil, fmt.Errorf("RPC call failed: %v", err)
+	}
+
+	return reply, nil
+}
+
+// Dump the container into the directory. The directory must be reachable from the nymph.
+func (c *Client) Checkpoint(containerRank container.Rank, dir string, leaveRunning bool) (*CheckpointReply, error) {
+	args := &CheckpointArgs{
+		Rank:         containerRank,
+		Dir:          dir,
+		LeaveRunning: leaveRunning,
+	}
+
+	var reply CheckpointReply
+	if err := c.client.Call(rpcCheckpoint, args, &reply); err != nil {
+		return nil, fmt.Errorf("RPC call failed: %v", err)
+	}
+
+	return &reply, nil
+}
+
+// Restore a container from the directory written by Checkpoint. Returns the rank of the
+// restored container.
+func (c *Client) Restore(dir string) (container.Rank, error) {
+	args := &RestoreArgs{dir}
+
+	var reply container.Rank
+	if err := c.client.Call(rpcRestore, args, &reply); err != nil {
+		return reply, fmt.Errorf("RPC call failed: %v", err)
+	}
+
+	return reply, nil
+}
+
+// Restore a container from a checkpoint, that a buddy has replicated to the nymph
+func (c *Client) RestoreReplica(image container.ImageInfoArgs) error {
+	args := &RestoreReplicaArgs{image}
+
+	var reply bool
+	if err := c.client.Call(rpcRestoreReplica, args, &reply); err != nil {
+		return fmt.Errorf("RPC call failed: %v", err)
+	}
+
+	return nil
+}
+
+// Drop the replicated generations of the container, except the ones to keep
+func (c *Client) DropReplicas(rank container.Rank, id string, keep []int) error {
+	args := &DropReplicasArgs{
+		Rank: rank,
+		ID:   id,
+		Keep: keep,
+	}
+
+	var reply bool
+	if err := c.client.Call(rpcDropReplicas, args, &reply); err != nil {
+		return fmt.Errorf("RPC call failed: %v", err)
+	}
+
+	return nil
 }
 
 func (c *Client) Close() {
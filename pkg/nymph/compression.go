@@ -0,0 +1,89 @@
+package nymph
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Compression of file data sent between nymphs during migration. Every chunk is compressed
+// on its own, so the recipient can decompress the chunks as they arrive.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZlib = "zlib"
+)
+
+func SupportsCompression(compression string) bool {
+	switch compression {
+	case CompressionNone, CompressionGzip, CompressionZlib:
+		return true
+	default:
+		return false
+	}
+}
+
+func Compress(compression string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	var err error
+
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		writer, err = gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	case CompressionZlib:
+		writer, err = zlib.NewWriterLevel(&buf, zlib.BestSpeed)
+	default:
+		return nil, fmt.Errorf("Unknown compression: %v", compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompress a chunk, that is expected to be not larger than the limit
+func Decompress(compression string, data []byte, limit int64) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case CompressionZlib:
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("Unknown compression: %v", compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	result, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(result)) > limit {
+		return nil, fmt.Errorf("Decompressed data exceeds %v bytes", limit)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,196 @@
+package nymph
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+)
+
+// Checkpoint data can bypass RPC and travel over a separate TCP connection, the data channel.
+// The donor first sends the session ID and then a stream of frames. Each frame is a header
+// followed by a chunk of a file. A sync frame asks the recipient to report, whether all
+// chunks since the previous sync have been written.
+
+// Handle of a sync frame
+const DataSync = -1
+
+// Longest status message the recipient sends back
+const maxStatusLen = 1 << 16
+
+type dataHeader struct {
+	Handle int64
+	Offset int64
+	Length int64
+}
+
+func writeString(w io.Writer, str string) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(str))); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, str)
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+
+	if length > maxStatusLen {
+		return "", fmt.Errorf("String is too long: %v", length)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// Read the session ID, that starts a data channel
+func ReadDataSession(r io.Reader) (string, error) {
+	return readString(r)
+}
+
+// Read the header of the next frame. Returns io.EOF, if the donor has closed the channel.
+func ReadDataHeader(r io.Reader) (handle int, offset int64, length int64, err error) {
+	var header dataHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return int(header.Handle), header.Offset, header.Length, nil
+}
+
+// Report the result of the frames since the previous sync. No error means success.
+func WriteDataStatus(w io.Writer, status error) error {
+	msg := ""
+	if status != nil {
+		msg = status.Error()
+	}
+
+	return writeString(w, msg)
+}
+
+// Data channel of a migration client
+type DataChannel struct {
+	client *MigrationClient
+	conn   *net.TCPConn
+}
+
+// Open a data channel to the recipient. Fails, if the recipient does not accept data
+// channels, then the data has to be sent with FileData.
+func (m *MigrationClient) OpenDataChannel() (*DataChannel, error) {
+	var port int
+	err := m.client.Call(rpcDataPort, &container.DataPortArgs{}, &port)
+	if err != nil {
+		return nil, m.track(err)
+	}
+
+	address := net.JoinHostPort(m.hostname, strconv.Itoa(port))
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot reach the data channel (%v): %v", address, err)
+	}
+
+	if err := writeString(conn, m.session); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to send the session: %v", err)
+	}
+
+	log.WithField("address", address).Debug("Opened data channel")
+
+	return &DataChannel{
+		client: m,
+		conn:   conn.(*net.TCPConn),
+	}, nil
+}
+
+// Failed writes or reads mean, that the connection to the recipient is gone
+func (d *DataChannel) lose(err error) error {
+	d.client.lose()
+	return err
+}
+
+// Send a chunk of a file from memory
+func (d *DataChannel) SendChunk(handle int, offset int64, data []byte) error {
+	header := make([]byte, binary.Size(dataHeader{}))
+	binary.BigEndian.PutUint64(header[0:], uint64(handle))
+	binary.BigEndian.PutUint64(header[8:], uint64(offset))
+	binary.BigEndian.PutUint64(header[16:], uint64(len(data)))
+
+	// Header and data go out in one system call
+	buffers := net.Buffers{header, data}
+	if _, err := buffers.WriteTo(d.conn); err != nil {
+		return d.lose(fmt.Errorf("Failed to send chunk: %v", err))
+	}
+
+	return nil
+}
+
+// Send a chunk of a file straight from the file. The kernel copies the data to the socket
+// without passing it through user space.
+func (d *DataChannel) SendFileRange(handle int, file *os.File, offset int64, length int64) error {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("Failed to seek: %v", err)
+	}
+
+	header := dataHeader{
+		Handle: int64(handle),
+		Offset: offset,
+		Length: length,
+	}
+	if err := binary.Write(d.conn, binary.BigEndian, &header); err != nil {
+		return d.lose(fmt.Errorf("Failed to send chunk header: %v", err))
+	}
+
+	// TCPConn.ReadFrom uses sendfile for a limited file reader
+	sent, err := d.conn.ReadFrom(io.LimitReader(file, length))
+	if err != nil {
+		return d.lose(fmt.Errorf("Failed to send chunk: %v", err))
+	}
+
+	if sent != length {
+		// The frame is incomplete, so the stream is unusable
+		return d.lose(fmt.Errorf("File is shorter than expected: sent %v of %v bytes", sent, length))
+	}
+
+	return nil
+}
+
+// Wait until the recipient has written all chunks sent so far. Returns the error of the
+// recipient, if any of them failed.
+func (d *DataChannel) Sync() error {
+	header := dataHeader{
+		Handle: DataSync,
+	}
+	if err := binary.Write(d.conn, binary.BigEndian, &header); err != nil {
+		return d.lose(fmt.Errorf("Failed to send sync: %v", err))
+	}
+
+	status, err := readString(d.conn)
+	if err != nil {
+		return d.lose(fmt.Errorf("Failed to receive status: %v", err))
+	}
+
+	if status != "" {
+		return errors.New(status)
+	}
+
+	return nil
+}
+
+func (d *DataChannel) Close() {
+	d.conn.Close()
+}
@@ -2,9 +2,9 @@
 package nymph
 
 import (
-	"fmt"
 	"net/rpc"
 	"os"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 
@@ -15,8 +15,13 @@ import (
 
 // Client to connect to the nymph recipient daemon during migration
 type MigrationClient struct {
-	client *rpc.Client
-	seq    int
+	client   *rpc.Client
+	hostname string
+	session  string
+
+	// Set, once a call fails because of the connection
+	mutex sync.Mutex
+	lost  bool
 }
 
 // Create new connection to a nymph.
@@ -33,10 +38,94 @@ func NewMigrationClient(hostname string) (*MigrationClient, error) {
 	}).Info("Connected to a nymph")
 
 	return &MigrationClient{
-		client: rpcClient,
+		client:   rpcClient,
+		hostname: hostname,
 	}, nil
 }
 
+// Remember, if a call failed, because the connection is gone. Errors returned by the
+// recipient itself leave the connection usable.
+func (m *MigrationClient) track(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(rpc.ServerError); !ok {
+		m.lose()
+	}
+
+	return err
+}
+
+func (m *MigrationClient) lose() {
+	m.mutex.Lock()
+	m.lost = true
+	m.mutex.Unlock()
+}
+
+// Check, if the connection to the recipient has been lost
+func (m *MigrationClient) Lost() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.lost
+}
+
+// Agree with the recipient on the compression of file data. Returns the first of the offered
+// compressions, that the recipient supports.
+func (m *MigrationClient) Negotiate(compressions []string) (string, error) {
+	args := &container.NegotiateArgs{
+		Compressions: compressions,
+	}
+
+	var compression string
+	err := m.client.Call(rpcNegotiate, args, &compression)
+	if err != nil {
+		return "", m.track(err)
+	}
+
+	log.WithFields(log.Fields{
+		"offered":     compressions,
+		"compression": compression,
+	}).Debug("Negotiated compression")
+
+	return compression, nil
+}
+
+// Open a transfer session or join an existing one after reconnecting. Returns what the
+// recipient has received in the session so far.
+func (m *MigrationClient) OpenSession(session string) (*container.SessionState, error) {
+	args := &container.OpenSessionArgs{
+		Session: session,
+	}
+
+	var state container.SessionState
+	err := m.client.Call(rpcOpenSession, args, &state)
+	if err != nil {
+		return nil, m.track(err)
+	}
+	m.session = session
+
+	log.WithFields(log.Fields{
+		"session": session,
+		"files":   len(state.Files),
+	}).Debug("Opened transfer session")
+
+	return &state, nil
+}
+
+// Tell the recipient, that the session is over. If the migration did not finish, the
+// recipient discards the received files.
+func (m *MigrationClient) CloseSession(discard bool) error {
+	args := &container.CloseSessionArgs{
+		Session: m.session,
+		Discard: discard,
+	}
+
+	var reply bool
+	return m.track(m.client.Call(rpcCloseSession, args, &reply))
+}
+
 func (m *MigrationClient) ImageInfo(imageArgs *container.ImageInfoArgs) error {
 	log.WithFields(log.Fields{
 		"rank":       imageArgs.Rank,
@@ -45,18 +134,18 @@ func (m *MigrationClient) ImageInfo(imageArgs *container.ImageInfoArgs) error {
 		"parent":     imageArgs.Parent,
 	}).Debug("Send image info")
 
-	var seq int
-	err := m.client.Call(rpcImageInfo, imageArgs, &seq)
-	if err != nil {
-		return err
+	args := &container.CheckpointInfoArgs{
+		Session: m.session,
+		Image:   *imageArgs,
 	}
-	m.seq = seq
 
-	return nil
+	var reply bool
+	return m.track(m.client.Call(rpcImageInfo, args, &reply))
 }
 
 func (m *MigrationClient) LinkInfo(filename string, fileInfo os.FileInfo, link string) error {
 	args := &container.LinkInfoArgs{
+		Session:  m.session,
 		Filename: filename,
 		Link:     link,
 		Size:     fileInfo.Size(),
@@ -72,77 +161,123 @@ func (m *MigrationClient) LinkInfo(filename string, fileInfo os.FileInfo, link s
 		"ModTime": args.ModTime,
 	}).Debug("Sending link info")
 
-	var seq int
-	err := m.client.Call(rpcLinkInfo, args, &seq)
-	if err != nil {
-		return err
-	}
-	if seq != m.seq+1 {
-		return fmt.Errorf("Unexpected sequence number: %v", seq)
-	}
-	m.seq = seq
-
-	return nil
+	var reply bool
+	return m.track(m.client.Call(rpcLinkInfo, args, &reply))
 }
 
-func (m *MigrationClient) FileInfo(filename string, fileInfo os.FileInfo) error {
+// Announce a file to the recipient. Returns the handle, that the chunks of the file refer to.
+// Several files can be transferred at the same time.
+func (m *MigrationClient) FileInfo(filename string, fileInfo os.FileInfo, compression string) (int, error) {
 	args := &container.FileInfoArgs{
-		Filename: filename,
-		Size:     fileInfo.Size(),
-		Mode:     fileInfo.Mode(),
-		ModTime:  fileInfo.ModTime(),
+		Session:     m.session,
+		Filename:    filename,
+		Size:        fileInfo.Size(),
+		Mode:        fileInfo.Mode(),
+		ModTime:     fileInfo.ModTime(),
+		Compression: compression,
 	}
 
 	log.WithFields(log.Fields{
-		"File":    filename,
-		"Size":    args.Size,
-		"Mode":    args.Mode,
-		"ModTime": args.ModTime,
+		"File":        filename,
+		"Size":        args.Size,
+		"Mode":        args.Mode,
+		"ModTime":     args.ModTime,
+		"Compression": compression,
 	}).Debug("Sending file info")
 
-	var seq int
-	err := m.client.Call(rpcFileInfo, args, &seq)
+	var handle int
+	err := m.client.Call(rpcFileInfo, args, &handle)
 	if err != nil {
-		return err
+		return 0, m.track(err)
 	}
-	if seq != m.seq+1 {
-		return fmt.Errorf("Unexpected sequence number: %v", seq)
-	}
-	m.seq = seq
 
-	return nil
+	return handle, nil
 }
 
-func (m *MigrationClient) FileData(data []byte) error {
-	args := &container.FileDataArgs{data}
+// Send a chunk of a file without waiting for the recipient. The finished call is delivered
+// to the done channel and has to be checked with FileDataDone. The data is encoded before
+// the function returns, so the caller may reuse the buffer.
+func (m *MigrationClient) FileData(handle int, offset int64, data []byte, done chan *rpc.Call) *rpc.Call {
+	args := &container.FileDataArgs{
+		Session: m.session,
+		Handle:  handle,
+		Offset:  offset,
+		Data:    data,
+	}
 
-	log.WithField("size", len(data)).Trace("Sending chunk")
+	log.WithFields(log.Fields{
+		"handle": handle,
+		"offset": offset,
+		"size":   len(data),
+	}).Trace("Sending chunk")
 
-	var seq int
-	err := m.client.Call(rpcFileData, args, &seq)
-	if err != nil {
-		return err
-	}
-	if seq != m.seq+1 {
-		return fmt.Errorf("Unexpected sequence number: %v", seq)
+	return m.client.Go(rpcFileData, args, new(bool), done)
+}
+
+// Result of a chunk sent with FileData
+func (m *MigrationClient) FileDataDone(call *rpc.Call) error {
+	return m.track(call.Error)
+}
+
+// Send hashes of all files of the checkpoint. The recipient refuses the checkpoint, if
+// anything does not match.
+func (m *MigrationClient) Manifest(files container.Manifest) error {
+	args := &container.ManifestArgs{
+		Session: m.session,
+		Files:   files,
+		Hash:    files.Hash(),
 	}
-	m.seq = seq
 
-	return nil
+	log.WithFields(log.Fields{
+		"files": len(args.Files),
+		"hash":  args.Hash,
+	}).Debug("Sending manifest")
+
+	var reply bool
+	return m.track(m.client.Call(rpcManifest, args, &reply))
 }
 
-func (m *MigrationClient) Relaunch() error {
-	args := &container.RelaunchArgs{}
+func (m *MigrationClient) Relaunch(args *container.RelaunchArgs) error {
+	log.WithFields(log.Fields{
+		"lazy_address": args.LazyPagesAddress,
+		"lazy_port":    args.LazyPagesPort,
+	}).Debug("Relaunching the container")
 
-	log.Debug("Relaunching the container")
+	args.Session = m.session
 
-	var seq int
-	err := m.client.Call(rpcRelaunch, args, &seq)
+	var reply bool
+	return m.track(m.client.Call(rpcRelaunch, args, &reply))
+}
+
+// Ask the recipient to start a CRIU page server, that stores pages of the checkpoint.
+// Returns the port the page server listens at.
+func (m *MigrationClient) StartPageServer(args *container.PageServerArgs) (int, error) {
+	log.WithFields(log.Fields{
+		"id":         args.ID,
+		"generation": args.Generation,
+		"parent":     args.Parent,
+	}).Debug("Requesting page server")
+
+	args.Session = m.session
+
+	var reply container.PageServerReply
+	err := m.client.Call(rpcStartPageServer, args, &reply)
 	if err != nil {
-		return err
+		return 0, m.track(err)
+	}
+
+	return reply.Port, nil
+}
+
+// Wait until the page server at the recipient stores all pages and exits
+func (m *MigrationClient) FinishPageServer(abort bool) error {
+	args := &container.FinishPageServerArgs{
+		Session: m.session,
+		Abort:   abort,
 	}
 
-	return nil
+	var reply bool
+	return m.track(m.client.Call(rpcFinishPageServer, args, &reply))
 }
 
 func (c *MigrationClient) Close() {
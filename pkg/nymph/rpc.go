@@ -14,7 +14,16 @@ const (
 
 	rpcSignal = "Nymph.Signal"
 
-	rpcRun = "Nymph.Run"
+	rpcRun  = "Nymph.Run"
+	rpcWait = "Nymph.Wait"
+
+	rpcListContainers = "Nymph.ListContainers"
+
+	rpcCheckpoint = "Nymph.Checkpoint"
+	rpcRestore    = "Nymph.Restore"
+
+	rpcRestoreReplica = "Nymph.RestoreReplica"
+	rpcDropReplicas   = "Nymph.DropReplicas"
 )
 
 // Container receiving server actually expects no parameters
@@ -22,9 +31,23 @@ type ReceiveArgs struct {
 }
 
 type SendArgs struct {
+	// ID assigned by the coordinator, that the nymphs report progress under
+	MigrationID   uint64
 	ContainerRank container.Rank
 	Host          string
 	MigrationType container.MigrationType
+	Opts          container.MigrationOpts
+}
+
+type SendReply struct {
+	// Statistics of every dump made during the migration
+	Dumps []container.DumpStats
+	// The migration failed, but the container was restored at the donor
+	RolledBack bool
+	// Reason of the rollback
+	Error string
+	// Memory pages went through a page server and are not covered by the manifest
+	PagesUnverified bool
 }
 
 type CreateContainerArgs struct {
@@ -46,12 +69,69 @@ type RunArgs struct {
 	Image string
 	Args  []string
 	Init  bool
+	// Seconds between periodic checkpoints. Zero takes the interval from the nymph
+	// configuration, a negative interval disables them.
+	CheckpointInterval int
+}
+
+type ListContainersArgs struct {
+}
+
+type WaitArgs struct {
+	Rank container.Rank
+}
+
+type WaitReply struct {
+	Status container.ExitStatus
+	// The process did not exit, but left the nymph during migration
+	Migrated bool
+	// The process did not exit, but was stopped after a dump into a storage directory
+	Checkpointed bool
+}
+
+// Dump a container into a directory outside of the nymph root
+type CheckpointArgs struct {
+	Rank container.Rank
+	// Absolute path at the nymph
+	Dir string
+	// Keep the container running, instead of stopping it after the dump
+	LeaveRunning bool
+}
+
+type CheckpointReply struct {
+	Image container.ImageInfoArgs
+	Stats container.DumpStats
+}
+
+type RestoreArgs struct {
+	Dir string
+}
+
+// Restore a container from a checkpoint replicated to the nymph by a buddy
+type RestoreReplicaArgs struct {
+	Image container.ImageInfoArgs
+}
+
+// Remove replicated generations, that the buddy does not need anymore
+type DropReplicasArgs struct {
+	Rank container.Rank
+	ID   string
+	// Generations of the live chain, nil to drop all replicas of the container
+	Keep []int
 }
 
 const (
-	rpcImageInfo = "Recipient.ImageInfo"
-	rpcLinkInfo  = "Recipient.LinkInfo"
-	rpcFileInfo  = "Recipient.FileInfo"
-	rpcFileData  = "Recipient.FileData"
-	rpcRelaunch  = "Recipient.Relaunch"
+	rpcNegotiate    = "Recipient.Negotiate"
+	rpcOpenSession  = "Recipient.OpenSession"
+	rpcCloseSession = "Recipient.CloseSession"
+	rpcImageInfo    = "Recipient.ImageInfo"
+	rpcLinkInfo     = "Recipient.LinkInfo"
+	rpcFileInfo     = "Recipient.FileInfo"
+	rpcFileData     = "Recipient.FileData"
+	rpcManifest     = "Recipient.Manifest"
+	rpcDataPort     = "Recipient.DataPort"
+	rpcRelaunch     = "Recipient.Relaunch"
+
+	rpcStartPageServer  = "Recipient.StartPageServer"
+	rpcFinishPageServer = "Recipient.FinishPageServer"
 )
@@ -0,0 +1,205 @@
+package coordinator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/config"
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/coordinator"
+)
+
+const (
+	// A host offered to a rank counts as occupied until the rank registers, or until
+	// the offer expires.
+	allocationTTL = time.Minute
+)
+
+type allocation struct {
+	location Location
+	offered  time.Time
+}
+
+// Hosts offered to ranks, that have not registered yet
+type allocations struct {
+	offers map[container.Rank]allocation
+}
+
+func newAllocations() *allocations {
+	return &allocations{
+		offers: make(map[container.Rank]allocation),
+	}
+}
+
+func (a *allocations) Add(rank container.Rank, location Location) {
+	a.offers[rank] = allocation{location, time.Now()}
+}
+
+func (a *allocations) Del(rank container.Rank) {
+	delete(a.offers, rank)
+}
+
+// Number of pending offers per location. Expired offers are dropped.
+func (a *allocations) Count() map[Location]int {
+	count := make(map[Location]int)
+	for rank, offer := range a.offers {
+		if time.Since(offer.offered) > allocationTTL {
+			delete(a.offers, rank)
+			continue
+		}
+		count[offer.location]++
+	}
+
+	return count
+}
+
+type allocationCandidate struct {
+	location       Location
+	containerCount int
+	metrics        NymphMetrics
+	// CPUs of the nymph. Nymphs, that did not report their resources yet, are assumed to
+	// have as many CPUs as the reporting nymphs on average.
+	cpuCount float64
+}
+
+// How many CPUs are still free at the nymph. Every container takes at least one CPU.
+func (a *allocationCandidate) freeCpus() float64 {
+	return a.cpuCount - math.Max(a.metrics.Load1, float64(a.containerCount))
+}
+
+// Check, if the container fits into the memory of the nymph, keeping the configured amount
+// free. Nymphs, that did not report their resources yet, take any container.
+func (a *allocationCandidate) fits(memory, minFreeMemory uint64) bool {
+	return a.metrics.MemoryTotal == 0 || a.metrics.MemoryFree >= memory+minFreeMemory
+}
+
+// Account for a container planned to go to the nymph
+func (a *allocationCandidate) take(memory uint64) {
+	a.containerCount++
+	if a.metrics.MemoryFree > memory {
+		a.metrics.MemoryFree -= memory
+	} else {
+		a.metrics.MemoryFree = 0
+	}
+}
+
+// True, if the candidate a is a better place for a new container than b
+func (a *allocationCandidate) betterThan(b *allocationCandidate) bool {
+	if a.freeCpus() != b.freeCpus() {
+		return a.freeCpus() > b.freeCpus()
+	}
+
+	if a.containerCount != b.containerCount {
+		return a.containerCount < b.containerCount
+	}
+
+	if a.metrics.MemoryFree != b.metrics.MemoryFree {
+		return a.metrics.MemoryFree > b.metrics.MemoryFree
+	}
+
+	return a.location.Hostname < b.location.Hostname
+}
+
+func getMinFreeMemory() uint64 {
+	if megabytes, ok := config.GetIntOk(config.CoordinatorMinFreeMemory); ok {
+		return uint64(megabytes) << 20
+	}
+
+	return 0
+}
+
+// Average number of CPUs of the nymphs, that reported their resources, or one, if none did
+func averageCpuCount(metrics map[Location]NymphMetrics) float64 {
+	total, count := 0, 0
+	for _, nymph := range metrics {
+		if nymph.CpuCount != 0 {
+			total += nymph.CpuCount
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 1
+	}
+
+	return float64(total) / float64(count)
+}
+
+// Nymphs, that can take a new container, sorted from the best to the worst. A nymph must
+// have at least the configured amount of free memory, if it reported its resources.
+func (c *Control) allocationCandidates() []*allocationCandidate {
+	minFreeMemory := getMinFreeMemory()
+
+	infoMap := c.locationDB.LocationsStat()
+	pending := c.allocations.Count()
+	metrics := c.nymphSet.GetMetrics()
+	defaultCpus := averageCpuCount(metrics)
+
+	candidates := make([]*allocationCandidate, 0)
+	for _, location := range c.nymphSet.GetSchedulableNymphs() {
+		candidate := &allocationCandidate{
+			location:       location,
+			containerCount: infoMap[location].ContainerCount + pending[location],
+			metrics:        metrics[location],
+			cpuCount:       float64(metrics[location].CpuCount),
+		}
+
+		if candidate.cpuCount == 0 {
+			candidate.cpuCount = defaultCpus
+		}
+
+		if !candidate.fits(0, minFreeMemory) {
+			log.WithFields(log.Fields{
+				"nymph":       location.Hostname,
+				"memory_free": candidate.metrics.MemoryFree,
+			}).Debug("Not enough free memory")
+			continue
+		}
+
+		candidates = append(candidates, candidate)
+	}
+
+	sortCandidates(candidates)
+	return candidates
+}
+
+func sortCandidates(candidates []*allocationCandidate) {
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].betterThan(candidates[j])
+	})
+}
+
+// Pick an alive nymph with the most free capacity
+func (c *Control) allocateHost(args *AllocateHostArgs, reply interface{}) error {
+	hostname, ok := reply.(*string)
+	if !ok {
+		return fmt.Errorf("Failed to parse reply parameter")
+	}
+
+	location, ok := c.locationDB.Get(args.Rank)
+	if ok {
+		*hostname = location.Hostname
+		return nil
+	}
+
+	candidates := c.allocationCandidates()
+	if len(candidates) == 0 {
+		return fmt.Errorf("No location has been found")
+	}
+
+	best := candidates[0]
+	c.allocations.Add(args.Rank, best.location)
+	*hostname = best.location.Hostname
+
+	log.WithFields(log.Fields{
+		"rank":       args.Rank,
+		"host":       *hostname,
+		"containers": best.containerCount,
+		"free_cpus":  best.freeCpus(),
+	}).Info("Allocation offer")
+	return nil
+}
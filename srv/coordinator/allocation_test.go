@@ -0,0 +1,97 @@
+package coordinator
+
+import (
+	"testing"
+
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/coordinator"
+)
+
+// Control, that knows the nymphs with their last reported resources
+func newTestControl(nymphs map[string]NymphMetrics) *Control {
+	c := NewControl(&noneStateStore{})
+	for host, metrics := range nymphs {
+		c.nymphSet.Add(Location{host})
+		c.nymphSet.Heartbeat(Location{host}, metrics)
+	}
+
+	return c
+}
+
+func allocate(t *testing.T, c *Control, rank container.Rank) string {
+	var hostname string
+	if err := c.allocateHost(&AllocateHostArgs{Rank: rank}, &hostname); err != nil {
+		t.Fatalf("Failed to allocate rank %v: %v", rank, err)
+	}
+
+	return hostname
+}
+
+func TestUnreportedNymphScoresInCpus(t *testing.T) {
+	reported := allocationCandidate{location: Location{"a"}, containerCount: 2, cpuCount: 8,
+		metrics: NymphMetrics{CpuCount: 8}}
+	unreported := allocationCandidate{location: Location{"b"}, containerCount: 0, cpuCount: 8}
+
+	if reported.freeCpus() != 6 || unreported.freeCpus() != 8 {
+		t.Errorf("Expected 6 and 8 free CPUs, got %v and %v", reported.freeCpus(), unreported.freeCpus())
+	}
+
+	if !unreported.betterThan(&reported) {
+		t.Errorf("Empty unreported nymph should win over a busy one")
+	}
+
+	if averageCpuCount(map[Location]NymphMetrics{{"a"}: {CpuCount: 4}, {"b"}: {CpuCount: 8}, {"c"}: {}}) != 6 {
+		t.Errorf("Unreported nymphs should not change the average")
+	}
+
+	if averageCpuCount(map[Location]NymphMetrics{{"a"}: {}}) != 1 {
+		t.Errorf("Without reports every nymph counts as a single CPU")
+	}
+}
+
+func TestLoadOutweighsContainers(t *testing.T) {
+	loaded := allocationCandidate{location: Location{"a"}, containerCount: 1, cpuCount: 4,
+		metrics: NymphMetrics{CpuCount: 4, Load1: 3.5}}
+	idle := allocationCandidate{location: Location{"b"}, containerCount: 2, cpuCount: 4,
+		metrics: NymphMetrics{CpuCount: 4}}
+
+	if !idle.betterThan(&loaded) || loaded.betterThan(&idle) {
+		t.Errorf("Nymph with 2 free CPUs should win over one with %v", loaded.freeCpus())
+	}
+}
+
+func TestAllocateHostSpreadsOffers(t *testing.T) {
+	c := newTestControl(map[string]NymphMetrics{"a": {}, "b": {}})
+
+	// Pending offers count as containers, until the ranks register
+	for rank, expected := range []string{"a", "b", "a"} {
+		if host := allocate(t, c, container.Rank(rank)); host != expected {
+			t.Errorf("Expected rank %v at %v, got %v", rank, expected, host)
+		}
+	}
+
+	// A registered rank keeps its place
+	c.locationDB.Set(7, Location{"b"})
+	if host := allocate(t, c, 7); host != "b" {
+		t.Errorf("Expected known rank at b, got %v", host)
+	}
+}
+
+func TestAllocateHostPrefersFreeCpus(t *testing.T) {
+	c := newTestControl(map[string]NymphMetrics{"small": {CpuCount: 2}, "large": {CpuCount: 8}})
+	c.locationDB.Set(0, Location{"large"})
+	c.locationDB.Set(1, Location{"large"})
+
+	if host := allocate(t, c, 2); host != "large" {
+		t.Errorf("Expected the nymph with 6 free CPUs, got %v", host)
+	}
+}
+
+func TestAllocateHostWithoutNymphs(t *testing.T) {
+	c := newTestControl(nil)
+
+	var hostname string
+	if err := c.allocateHost(&AllocateHostArgs{Rank: 0}, &hostname); err == nil {
+		t.Errorf("Expected no host, got %v", hostname)
+	}
+}
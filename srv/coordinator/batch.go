@@ -0,0 +1,176 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/coordinator"
+)
+
+type evacuationArgs struct {
+	host string
+}
+
+// Memory used by every container of the nymph, as last reported by the nymph
+func (c *Control) containerMemory(location Location) map[container.Rank]uint64 {
+	memory := make(map[container.Rank]uint64)
+	for _, cont := range c.nymphSet.GetMetrics()[location].Containers {
+		memory[cont.Rank] = cont.MemoryUsage
+	}
+
+	return memory
+}
+
+// Choose a destination for every rank of the evacuated host. Each rank goes to the best
+// allocation candidate, that has enough free memory for it, counting the ranks already
+// planned to go there. The host must be draining, so that it is not a candidate itself.
+func (c *Control) planEvacuationImpl(args *evacuationArgs, reply interface{}) error {
+	moves, ok := reply.(*[]RankMove)
+	if !ok {
+		return fmt.Errorf("Failed to parse reply parameter")
+	}
+
+	src := Location{args.host}
+	ranks := c.locationDB.Ranks(src)
+	sort.Slice(ranks, func(i, j int) bool { return ranks[i] < ranks[j] })
+
+	memory := c.containerMemory(src)
+	minFreeMemory := getMinFreeMemory()
+	candidates := c.allocationCandidates()
+
+	*moves = make([]RankMove, 0, len(ranks))
+	for _, rank := range ranks {
+		var best *allocationCandidate
+		for _, candidate := range candidates {
+			if candidate.fits(memory[rank], minFreeMemory) {
+				best = candidate
+				break
+			}
+		}
+
+		if best == nil {
+			return fmt.Errorf("No nymph can take rank %v of %v", rank, args.host)
+		}
+
+		best.take(memory[rank])
+		*moves = append(*moves, RankMove{Rank: rank, DestHost: best.location.Hostname})
+
+		sortCandidates(candidates)
+	}
+
+	return nil
+}
+
+// Check the moves before anything migrates. A rank, that cannot move, gets a failed outcome.
+func (c *Control) checkMove(move RankMove, seen map[container.Rank]bool) error {
+	if seen[move.Rank] {
+		return fmt.Errorf("Rank %v appears more than once", move.Rank)
+	}
+	seen[move.Rank] = true
+
+	src, ok := c.locationDB.Get(move.Rank)
+	if !ok {
+		return fmt.Errorf("Container %v is not known", move.Rank)
+	}
+
+	if src.Hostname == move.DestHost {
+		return fmt.Errorf("Container %v is already at %v", move.Rank, move.DestHost)
+	}
+
+	if !c.nymphSet.IsSchedulable(Location{move.DestHost}) {
+		return fmt.Errorf("Destination %v is not an alive nymph or is draining", move.DestHost)
+	}
+
+	return nil
+}
+
+// Plan the batch and run its migrations through the migration queue. At most
+// args.Parallel ranks of the batch migrate at a time. Returns, once every rank has
+// an outcome.
+func (c *Control) MigrateBatch(args *MigrateBatchArgs, reply *MigrateBatchReply) error {
+	if args.Evacuate != "" && len(args.Moves) > 0 {
+		return fmt.Errorf("A batch either evacuates a host or lists the moves")
+	}
+
+	moves := args.Moves
+	if args.Evacuate != "" {
+		src := Location{args.Evacuate}
+		if !c.nymphSet.Drain(src) {
+			return fmt.Errorf("Nymph %v is not known", args.Evacuate)
+		}
+		defer c.nymphSet.Undrain(src)
+
+		if err := c.RequestReply(&evacuationArgs{args.Evacuate}, &moves); err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"moves":    moves,
+		"evacuate": args.Evacuate,
+		"parallel": args.Parallel,
+	}).Info("Received a batch migration")
+
+	parallel := args.Parallel
+	if parallel <= 0 {
+		parallel = len(moves)
+	}
+	slots := make(chan struct{}, parallel)
+
+	outcomes := make([]RankOutcome, len(moves))
+	seen := make(map[container.Rank]bool)
+
+	var wg sync.WaitGroup
+	for i, move := range moves {
+		outcome := &outcomes[i]
+		outcome.Rank = move.Rank
+		outcome.Dest = move.DestHost
+		if src, ok := c.locationDB.Get(move.Rank); ok {
+			outcome.Src = src.Hostname
+		}
+
+		if err := c.checkMove(move, seen); err != nil {
+			outcome.Outcome = PhaseFailed
+			outcome.Error = err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func(move RankMove) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			migrateReply := &MigrateReply{}
+			job := c.migrations.Submit(&MigrateArgs{
+				Rank:          move.Rank,
+				DestHost:      move.DestHost,
+				MigrationType: args.MigrationType,
+				Opts:          args.Opts,
+			}, migrateReply)
+			err := <-job.done
+
+			outcome.MigrationID = migrateReply.ID
+			switch {
+			case err != nil:
+				outcome.Outcome = PhaseFailed
+				outcome.Error = err.Error()
+			case migrateReply.RolledBack:
+				outcome.Outcome = PhaseRolledBack
+				outcome.Error = migrateReply.Error
+			default:
+				outcome.Outcome = PhaseDone
+			}
+		}(move)
+	}
+	wg.Wait()
+
+	reply.Outcomes = outcomes
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package coordinator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/coordinator"
+)
+
+const gib = 1 << 30
+
+// Evacuate host a, that is draining for the time of the batch
+func planEvacuation(c *Control, ranks ...container.Rank) ([]RankMove, error) {
+	for _, rank := range ranks {
+		c.locationDB.Set(rank, Location{"a"})
+	}
+	c.nymphSet.Drain(Location{"a"})
+
+	var moves []RankMove
+	err := c.planEvacuationImpl(&evacuationArgs{"a"}, &moves)
+	return moves, err
+}
+
+func TestPlanEvacuationSpreadsRanks(t *testing.T) {
+	c := newTestControl(map[string]NymphMetrics{"a": {}, "b": {}, "c": {}})
+	c.locationDB.Set(3, Location{"c"})
+
+	moves, err := planEvacuation(c, 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []RankMove{{Rank: 0, DestHost: "b"}, {Rank: 1, DestHost: "b"}, {Rank: 2, DestHost: "c"}}
+	if !reflect.DeepEqual(moves, expected) {
+		t.Errorf("Expected %v, got %v", expected, moves)
+	}
+}
+
+func TestPlanEvacuationFitsMemory(t *testing.T) {
+	c := newTestControl(map[string]NymphMetrics{
+		"a": {Containers: []ContainerMetrics{{Rank: 0, MemoryUsage: 3 * gib}}},
+		"b": {CpuCount: 4, MemoryTotal: 8 * gib, MemoryFree: 2 * gib},
+		"c": {CpuCount: 4, MemoryTotal: 8 * gib, MemoryFree: 4 * gib},
+	})
+
+	moves, err := planEvacuation(c, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rank 0 only fits into c, then b has more free CPUs for rank 1
+	expected := []RankMove{{Rank: 0, DestHost: "c"}, {Rank: 1, DestHost: "b"}}
+	if !reflect.DeepEqual(moves, expected) {
+		t.Errorf("Expected %v, got %v", expected, moves)
+	}
+}
+
+func TestPlanEvacuationFails(t *testing.T) {
+	alone := newTestControl(map[string]NymphMetrics{"a": {}})
+	if moves, err := planEvacuation(alone, 0); err == nil {
+		t.Errorf("The only nymph cannot be evacuated, got %v", moves)
+	}
+
+	tooBig := newTestControl(map[string]NymphMetrics{
+		"a": {Containers: []ContainerMetrics{{Rank: 0, MemoryUsage: 5 * gib}}},
+		"b": {CpuCount: 4, MemoryTotal: 8 * gib, MemoryFree: 4 * gib},
+	})
+	if moves, err := planEvacuation(tooBig, 0); err == nil {
+		t.Errorf("Rank does not fit anywhere, got %v", moves)
+	}
+
+	empty := newTestControl(map[string]NymphMetrics{"a": {}})
+	if moves, err := planEvacuation(empty); err != nil || len(moves) != 0 {
+		t.Errorf("Empty host needs no moves, got %v, %v", moves, err)
+	}
+}
+
+func TestDrainingNymphTakesNoRanks(t *testing.T) {
+	c := newTestControl(map[string]NymphMetrics{"a": {}, "b": {}})
+	c.nymphSet.Drain(Location{"a"})
+	c.nymphSet.Drain(Location{"a"})
+
+	if host := allocate(t, c, 0); host != "b" {
+		t.Errorf("Expected b, while a is draining, got %v", host)
+	}
+
+	// Overlapping evacuations keep the nymph draining until the last one finishes
+	c.nymphSet.Undrain(Location{"a"})
+	if c.nymphSet.IsSchedulable(Location{"a"}) {
+		t.Errorf("Nymph a is still draining")
+	}
+
+	c.nymphSet.Undrain(Location{"a"})
+	if !c.nymphSet.IsSchedulable(Location{"a"}) {
+		t.Errorf("Nymph a should take ranks again")
+	}
+}
+
+func TestCheckMove(t *testing.T) {
+	c := newTestControl(map[string]NymphMetrics{"a": {}, "b": {}, "c": {}})
+	for rank := container.Rank(0); rank < 3; rank++ {
+		c.locationDB.Set(rank, Location{"a"})
+	}
+	c.nymphSet.Drain(Location{"c"})
+
+	seen := make(map[container.Rank]bool)
+	if err := c.checkMove(RankMove{Rank: 0, DestHost: "b"}, seen); err != nil {
+		t.Errorf("Valid move rejected: %v", err)
+	}
+
+	for _, move := range []RankMove{
+		{Rank: 0, DestHost: "b"},       // twice in the batch
+		{Rank: 5, DestHost: "b"},       // unknown rank
+		{Rank: 1, DestHost: "a"},       // already there
+		{Rank: 1, DestHost: "c"},       // draining
+		{Rank: 2, DestHost: "unknown"}, // not a nymph
+	} {
+		if err := c.checkMove(move, seen); err == nil {
+			t.Errorf("Move %v should be rejected", move)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package coordinator
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/coordinator"
+	"github.com/planetA/konk/pkg/nymph"
+)
+
+// Latest good checkpoint of a rank, as reported by the nymph, that took it
+type checkpointRecord struct {
+	location Location
+	image    container.ImageInfoArgs
+	// Storage directory, empty if the checkpoint is kept only at the nymph
+	dir string
+	// Buddies holding a replica
+	replicas []string
+	created  time.Time
+}
+
+// Check, if the checkpoint survives the nymph, that took it
+func (r *checkpointRecord) durable() bool {
+	return r.dir != "" || len(r.replicas) > 0
+}
+
+// Checkpoints of the ranks. Only the control loop accesses it.
+type checkpointDB struct {
+	records map[container.Rank]checkpointRecord
+}
+
+func newCheckpointDB() *checkpointDB {
+	return &checkpointDB{
+		records: make(map[container.Rank]checkpointRecord),
+	}
+}
+
+func (d *checkpointDB) Set(rank container.Rank, record checkpointRecord) {
+	d.records[rank] = record
+}
+
+func (d *checkpointDB) Get(rank container.Rank) (checkpointRecord, bool) {
+	record, ok := d.records[rank]
+	return record, ok
+}
+
+func (d *checkpointDB) Del(rank container.Rank) bool {
+	_, ok := d.records[rank]
+	delete(d.records, rank)
+	return ok
+}
+
+func (c *Control) reportCheckpointImpl(args *ReportCheckpointArgs) error {
+	location := Location{args.Hostname}
+	if cur, ok := c.locationDB.Get(args.Rank); !ok || cur != location {
+		return fmt.Errorf("Container %v does not run at %v", args.Rank, args.Hostname)
+	}
+
+	c.checkpoints.Set(args.Rank, checkpointRecord{
+		location: location,
+		image:    args.Image,
+		dir:      args.Dir,
+		replicas: args.Replicas,
+		created:  args.Created,
+	})
+	c.record(StateEvent{
+		Type:     EventCheckpoint,
+		Rank:     args.Rank,
+		Hostname: args.Hostname,
+		Image:    &args.Image,
+		Dir:      args.Dir,
+		Replicas: args.Replicas,
+	})
+
+	log.WithFields(log.Fields{
+		"rank":       args.Rank,
+		"nymph":      args.Hostname,
+		"generation": args.Image.Generation,
+		"dir":        args.Dir,
+		"replicas":   args.Replicas,
+	}).Debug("Checkpoint has been reported")
+
+	return nil
+}
+
+// The nymph has started afresh and lost the replicas it held. Checkpoints, that are not
+// durable without it, cannot be restarted anymore.
+func (c *Control) forgetReplicas(buddy Location) {
+	for rank, record := range c.checkpoints.records {
+		replicas := make([]string, 0, len(record.replicas))
+		for _, replica := range record.replicas {
+			if replica != buddy.Hostname {
+				replicas = append(replicas, replica)
+			}
+		}
+
+		if len(replicas) == len(record.replicas) {
+			continue
+		}
+
+		record.replicas = replicas
+		c.checkpoints.Set(rank, record)
+
+		image := record.image
+		c.record(StateEvent{
+			Type:     EventCheckpoint,
+			Rank:     rank,
+			Hostname: record.location.Hostname,
+			Image:    &image,
+			Dir:      record.dir,
+			Replicas: record.replicas,
+		})
+
+		log.WithFields(log.Fields{
+			"rank":  rank,
+			"nymph": buddy.Hostname,
+		}).Info("Replica is gone with the nymph restart")
+	}
+}
+
+// The rank has finished, its checkpoints are not needed anymore. The buddies drop their
+// replicas in the background.
+func (c *Control) dropCheckpoint(rank container.Rank) {
+	record, ok := c.checkpoints.Get(rank)
+	if !ok {
+		return
+	}
+
+	c.checkpoints.Del(rank)
+	c.record(StateEvent{Type: EventDropCheckpoint, Rank: rank})
+
+	for _, buddy := range record.replicas {
+		go dropReplicas(rank, record.image.ID, buddy)
+	}
+}
+
+func dropReplicas(rank container.Rank, id string, buddy string) {
+	client, err := nymph.NewClientOnce(buddy)
+	if err == nil {
+		defer client.Close()
+		err = client.DropReplicas(rank, id, nil)
+	}
+
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"rank":  rank,
+			"buddy": buddy,
+		}).Warn("Failed to drop replicas")
+	}
+}
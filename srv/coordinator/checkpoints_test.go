@@ -0,0 +1,54 @@
+package coordinator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/planetA/konk/pkg/container"
+)
+
+// The store keeps the appended events in memory
+type recordingStateStore struct {
+	noneStateStore
+	events []StateEvent
+}
+
+func (s *recordingStateStore) Append(event StateEvent) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestForgetReplicas(t *testing.T) {
+	store := &recordingStateStore{}
+	c := NewControl(store)
+
+	image := container.ImageInfoArgs{ID: "cont", Generation: 1}
+	c.checkpoints.Set(0, checkpointRecord{location: Location{"a"}, image: image, replicas: []string{"b", "c"}})
+	c.checkpoints.Set(1, checkpointRecord{location: Location{"a"}, image: image, replicas: []string{"c"}})
+	c.checkpoints.Set(2, checkpointRecord{location: Location{"b"}, image: image, dir: "/storage"})
+
+	// Nymph b has started afresh
+	c.forgetReplicas(Location{"b"})
+
+	for rank, replicas := range map[container.Rank][]string{0: {"c"}, 1: {"c"}, 2: nil} {
+		record, _ := c.checkpoints.Get(rank)
+		if len(record.replicas)+len(replicas) > 0 && !reflect.DeepEqual(record.replicas, replicas) {
+			t.Errorf("Expected replicas %v of rank %v, got %v", replicas, rank, record.replicas)
+		}
+	}
+
+	// Only the changed record is persisted, so that a restarted coordinator knows as well
+	if len(store.events) != 1 {
+		t.Fatalf("Expected a single event, got %v", store.events)
+	}
+
+	event := store.events[0]
+	if event.Type != EventCheckpoint || event.Rank != 0 || !reflect.DeepEqual(event.Replicas, []string{"c"}) {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	record, _ := c.checkpoints.Get(2)
+	if !record.durable() {
+		t.Errorf("Checkpoint in the storage stays durable")
+	}
+}
@@ -2,7 +2,6 @@ package coordinator
 
 import (
 	"fmt"
-	"math"
 
 	log "github.com/sirupsen/logrus"
 
@@ -17,37 +16,63 @@ type Request struct {
 }
 
 type Control struct {
-	locationDB *LocationDB
-	nymphSet   *NymphSet
-	requests   chan Request
+	locationDB  *LocationDB
+	nymphSet    *NymphSet
+	allocations *allocations
+	checkpoints *checkpointDB
+	restarts    *restarts
+	fences      *fenceSet
+	store       StateStore
+	migrations  *migrationQueue
+	requests    chan Request
 }
 
-func NewControl() *Control {
+func NewControl(store StateStore) *Control {
 	return &Control{
-		locationDB: NewLocationDB(),
-		nymphSet:   NewNymphSet(),
-		requests:   make(chan Request),
+		locationDB:  NewLocationDB(),
+		nymphSet:    NewNymphSet(),
+		allocations: newAllocations(),
+		checkpoints: newCheckpointDB(),
+		restarts:    newRestarts(),
+		fences:      newFenceSet(),
+		store:       store,
+		migrations:  newMigrationQueue(),
+		requests:    make(chan Request),
 	}
 }
 
 func (c *Control) Start() {
+	c.runMigrations()
+
 	for req := range c.requests {
 		var err error
 		switch args := req.args.(type) {
 		case *AllocateHostArgs:
 			err = c.allocateHost(args, req.reply)
+		case *LocateContainerArgs:
+			err = c.locateImpl(args, req.reply)
 		case *RegisterContainerArgs:
 			err = c.registerImpl(args)
 		case *UnregisterContainerArgs:
 			err = c.unregisterImpl(args)
-		case *MigrateArgs:
-			err = c.migrateImpl(args)
-		case *SignalArgs:
-			err = c.signalImpl(args)
+		case *migrationDoneArgs:
+			err = c.migrationDoneImpl(args)
+		case *containerLostArgs:
+			err = c.containerLostImpl(args)
+		case *ReportCheckpointArgs:
+			err = c.reportCheckpointImpl(args)
+		case *FencedContainersArgs:
+			err = c.fencedContainersImpl(args, req.reply)
+		case *unfenceArgs:
+			err = c.unfenceImpl(args)
+		case *evacuationArgs:
+			err = c.planEvacuationImpl(args, req.reply)
 		case *RegisterNymphArgs:
 			err = c.registerNymphImpl(args, req.reply)
 		case *UnregisterNymphArgs:
 			err = c.unregisterNymphImpl(args)
+		case *livenessCheckArgs:
+			err = c.livenessCheckImpl()
 		default:
 			log.Printf("Arg: %v %T\n", args, args)
 			panic("Unknown argument")
@@ -83,61 +108,75 @@ func (c *Control) RequestReply(args interface{}, reply interface{}) error {
 	return nil
 }
 
-func (c *Control) allocateHost(args *AllocateHostArgs, reply interface{}) error {
+func (c *Control) locateImpl(args *LocateContainerArgs, reply interface{}) error {
 	hostname, ok := reply.(*string)
 	if !ok {
 		return fmt.Errorf("Failed to parse reply parameter")
 	}
 
 	location, ok := c.locationDB.Get(args.Rank)
-	if ok {
-		*hostname = location.Hostname
-		return nil
-	}
-
-	infoMap := c.locationDB.LocationsStat()
-
-	var minLocation Location
-	minLocationInfo := LocationInfo{
-		ContainerCount: math.MaxInt32,
-	}
-
-	for location, info := range infoMap {
-		if info.ContainerCount < minLocationInfo.ContainerCount {
-			minLocation = location
-			minLocationInfo = info
-		}
-	}
-
-	if minLocationInfo.ContainerCount == math.MaxInt32 {
-		return fmt.Errorf("No location has been found")
+	if !ok {
+		return fmt.Errorf("Container %v is not known", args.Rank)
 	}
 
-	*hostname = minLocation.Hostname
-
-	log.Printf("Allocation offer: %v", *hostname)
+	*hostname = location.Hostname
 	return nil
 }
 
 func (c *Control) registerImpl(args *RegisterContainerArgs) error {
+	if c.fences.Has(Location{args.Hostname}, args.Rank) {
+		return fmt.Errorf("Container %v has been restarted elsewhere, the copy at %v must go", args.Rank, args.Hostname)
+	}
+
 	c.locationDB.Set(args.Rank, Location{args.Hostname})
-	log.Printf("Request to register: %v\n\t\t%v", args, c.locationDB.Dump().db)
+	c.allocations.Del(args.Rank)
+	c.record(StateEvent{Type: EventRegisterContainer, Rank: args.Rank, Hostname: args.Hostname})
+	log.Printf("Request to register: %v", args)
 
 	return nil
 }
 
 func (c *Control) unregisterImpl(args *UnregisterContainerArgs) error {
 	curHost := Location{args.Hostname}
+	if c.unfence(curHost, args.Rank) {
+		// The nymph has destroyed the fenced copy, the restarted rank is not affected
+		log.WithFields(log.Fields{
+			"rank":  args.Rank,
+			"nymph": args.Hostname,
+		}).Info("Fenced copy is gone")
+		return nil
+	}
+
 	if err := c.locationDB.Unset(args.Rank, curHost); err != nil {
 		log.Println(err)
+	} else {
+		c.record(StateEvent{Type: EventUnregisterContainer, Rank: args.Rank, Hostname: args.Hostname})
+		c.dropCheckpoint(args.Rank)
 	}
-	log.Printf("Request to unregister: %v -- %v\n\t\t%v", curHost, args, c.locationDB.Dump().db)
+	log.Printf("Request to unregister: %v -- %v", curHost, args)
 
 	return nil
 }
 
-func (c *Control) migrateImpl(args *MigrateArgs) error {
+// Internal request to move a rank to its new location after a migration
+type migrationDoneArgs struct {
+	Rank container.Rank
+	Dest Location
+}
+
+// Internal request to forget a rank, that neither the source nor the destination runs
+type containerLostArgs struct {
+	Rank container.Rank
+	Src  Location
+}
+
+// Runs in a worker of the migration queue. Changes of the state go through the control loop.
+func (c *Control) migrateImpl(job *migrationJob) error {
+	args := job.args
+	reply := job.reply
+
 	log.WithFields(log.Fields{
+		"id":   reply.ID,
 		"rank": args.Rank,
 		"dest": args.DestHost,
 		"type": args.MigrationType,
@@ -147,32 +186,110 @@ func (c *Control) migrateImpl(args *MigrateArgs) error {
 	if !ok {
 		return fmt.Errorf("Container %v is not known", args.Rank)
 	}
+	c.migrations.setSource(job, src)
+
+	if !c.nymphSet.IsSchedulable(Location{args.DestHost}) {
+		return fmt.Errorf("Destination %v is not an alive nymph or is draining", args.DestHost)
+	}
 
-	if err := Migrate(args.Rank, src.Hostname, args.DestHost, args.MigrationType); err != nil {
+	sendReply, err := Migrate(reply.ID, args.Rank, src.Hostname, args.DestHost, args.MigrationType, args.Opts)
+	if err != nil {
+		c.checkMigrationSource(args.Rank, src)
 		return fmt.Errorf("Failed to migrate: %v", err)
 	}
 
+	reply.Dumps = sendReply.Dumps
+	reply.RolledBack = sendReply.RolledBack
+	reply.Error = sendReply.Error
+	reply.PagesUnverified = sendReply.PagesUnverified
+
+	if sendReply.RolledBack {
+		// The container keeps running at the source
+		return nil
+	}
+
 	if args.MigrationType != container.PreDump {
-		c.locationDB.Set(args.Rank, Location{args.DestHost})
+		return c.Request(&migrationDoneArgs{Rank: args.Rank, Dest: Location{args.DestHost}})
 	}
 
 	return nil
 }
 
-func (c *Control) signalImpl(args *SignalArgs) error {
+func (c *Control) migrationDoneImpl(args *migrationDoneArgs) error {
+	c.locationDB.Set(args.Rank, args.Dest)
+	c.record(StateEvent{Type: EventMigrateContainer, Rank: args.Rank, Hostname: args.Dest.Hostname})
+
+	return nil
+}
+
+// After a failed migration, the container can be lost, if the source could not restore it.
+// Forget the container then, so that nobody waits for it anymore.
+func (c *Control) checkMigrationSource(rank container.Rank, src Location) {
+	ranks, err := queryNymph(src)
+	if err != nil {
+		log.WithError(err).WithField("nymph", src.Hostname).Warn("Failed to check migration source")
+		return
+	}
+
+	for _, cur := range ranks {
+		if cur == rank {
+			return
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"rank":  rank,
+		"nymph": src.Hostname,
+	}).Error("Container has been lost during migration")
+
+	if err := c.Request(&containerLostArgs{Rank: rank, Src: src}); err != nil {
+		log.WithError(err).WithField("rank", rank).Error("Failed to forget the container")
+	}
+}
+
+func (c *Control) containerLostImpl(args *containerLostArgs) error {
+	if err := c.locationDB.Unset(args.Rank, args.Src); err != nil {
+		return err
+	}
+
+	c.record(StateEvent{Type: EventUnregisterContainer, Rank: args.Rank, Hostname: args.Src.Hostname})
+	return nil
+}
+
+// Deliver a signal to the ranks. The nymphs are contacted outside of the control loop, so
+// that a slow nymph does not hold up other requests.
+func (c *Control) Signal(args *SignalArgs) error {
 	signal := args.Signal
 
-	log.Printf("Received a signal notification: %v\n", signal)
+	log.WithFields(log.Fields{
+		"signal": signal,
+		"ranks":  args.Ranks,
+	}).Info("Received a signal notification")
+
+	var targets map[container.Rank]Location
+	rankErrors := make(RankErrors)
+	if len(args.Ranks) == 0 {
+		targets = c.locationDB.Copy()
+	} else {
+		targets = make(map[container.Rank]Location)
+		for _, rank := range args.Ranks {
+			loc, ok := c.locationDB.Get(rank)
+			if !ok {
+				rankErrors.Add(rank, fmt.Errorf("Container %v is not known", rank))
+				continue
+			}
+			targets[rank] = loc
+		}
+	}
 
-	var anyErr error
-	for rank, loc := range c.locationDB.Dump().db {
+	for rank, loc := range targets {
 		log.Printf("Sending signal %v to %v\n", signal, rank)
 		if err := Signal(rank, loc.Hostname, signal); err != nil {
-			anyErr = err
+			rankErrors.Add(rank, err)
 		}
 	}
 
-	return anyErr
+	return rankErrors.ErrorOrNil()
 }
 
 func (c *Control) registerNymphImpl(args *RegisterNymphArgs, reply interface{}) error {
@@ -183,6 +300,11 @@ func (c *Control) registerNymphImpl(args *RegisterNymphArgs, reply interface{})
 	}
 
 	*id = int(c.nymphSet.Add(Location{args.Hostname}))
+	c.record(StateEvent{Type: EventRegisterNymph, Hostname: args.Hostname, NymphId: uint(*id)})
+
+	if args.Fresh {
+		c.forgetReplicas(Location{args.Hostname})
+	}
 	log.Printf("Registered a nymph: %v id=%v\n\t\t%v\n", args, *id, c.nymphSet.GetNymphs())
 	return nil
 }
@@ -195,5 +317,6 @@ func (c *Control) unregisterNymphImpl(args *UnregisterNymphArgs) error {
 		return fmt.Errorf("Nymph was not registered")
 	}
 
+	c.record(StateEvent{Type: EventUnregisterNymph, Hostname: args.Hostname})
 	return nil
 }
@@ -15,11 +15,28 @@ func Run() error {
 	}
 	defer listener.Close()
 
-	control := NewControl()
+	storeType, _ := config.GetStringOk(config.CoordinatorStateType)
+	storePath, _ := config.GetStringOk(config.CoordinatorStatePath)
+	store, err := NewStateStore(storeType, storePath)
+	if err != nil {
+		return fmt.Errorf("Can't open coordinator state: %v", err)
+	}
+	defer store.Close()
+
+	control := NewControl(store)
+	if err := control.Restore(); err != nil {
+		return err
+	}
+	control.Reconcile()
+
 	go control.Start()
+	go control.MonitorLiveness()
 
-	// scheduler := NewScheduler(control)
-	// go scheduler.Start()
+	scheduler, err := NewSchedulerLoop(control)
+	if err != nil {
+		return fmt.Errorf("Can't create scheduler: %v", err)
+	}
+	go scheduler.Start()
 
 	coord := NewCoordinator(control)
 	rpc.Register(coord)
@@ -0,0 +1,40 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/planetA/konk/pkg/container"
+)
+
+// Collection of errors that happened while processing several ranks
+type RankErrors map[container.Rank]error
+
+func (e RankErrors) Add(rank container.Rank, err error) {
+	e[rank] = err
+}
+
+// Returns nil, if no errors have been collected
+func (e RankErrors) ErrorOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+func (e RankErrors) Error() string {
+	ranks := make([]int, 0, len(e))
+	for rank := range e {
+		ranks = append(ranks, int(rank))
+	}
+	sort.Ints(ranks)
+
+	msgs := make([]string, len(ranks))
+	for i, rank := range ranks {
+		msgs[i] = fmt.Sprintf("rank %v: %v", rank, e[container.Rank(rank)])
+	}
+
+	return fmt.Sprintf("%v rank(s) failed: %v", len(e), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,103 @@
+package coordinator
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/coordinator"
+)
+
+// Copies of ranks at nymphs, that have been declared dead, while the ranks are restarted
+// elsewhere. A nymph, that comes back, must destroy the fenced copies instead of registering
+// them again. Only the control loop accesses it.
+type fenceSet struct {
+	fences map[Location]map[container.Rank]bool
+}
+
+func newFenceSet() *fenceSet {
+	return &fenceSet{
+		fences: make(map[Location]map[container.Rank]bool),
+	}
+}
+
+func (f *fenceSet) Add(location Location, rank container.Rank) {
+	ranks, ok := f.fences[location]
+	if !ok {
+		ranks = make(map[container.Rank]bool)
+		f.fences[location] = ranks
+	}
+
+	ranks[rank] = true
+}
+
+func (f *fenceSet) Has(location Location, rank container.Rank) bool {
+	return f.fences[location][rank]
+}
+
+func (f *fenceSet) Del(location Location, rank container.Rank) bool {
+	ranks, ok := f.fences[location]
+	if !ok || !ranks[rank] {
+		return false
+	}
+
+	delete(ranks, rank)
+	if len(ranks) == 0 {
+		delete(f.fences, location)
+	}
+
+	return true
+}
+
+// Fenced ranks at the nymph
+func (f *fenceSet) Ranks(location Location) []container.Rank {
+	ranks := make([]container.Rank, 0, len(f.fences[location]))
+	for rank := range f.fences[location] {
+		ranks = append(ranks, rank)
+	}
+
+	return ranks
+}
+
+// Internal request to lift the fence, because the rank could not be restarted. The copy at
+// the old nymph is the only one left then.
+type unfenceArgs struct {
+	rank     container.Rank
+	location Location
+}
+
+func (c *Control) fence(location Location, rank container.Rank) {
+	c.fences.Add(location, rank)
+	c.record(StateEvent{Type: EventFence, Rank: rank, Hostname: location.Hostname})
+}
+
+func (c *Control) unfence(location Location, rank container.Rank) bool {
+	if !c.fences.Del(location, rank) {
+		return false
+	}
+
+	c.record(StateEvent{Type: EventUnfence, Rank: rank, Hostname: location.Hostname})
+	return true
+}
+
+func (c *Control) unfenceImpl(args *unfenceArgs) error {
+	if c.unfence(args.location, args.rank) {
+		log.WithFields(log.Fields{
+			"rank":  args.rank,
+			"nymph": args.location.Hostname,
+		}).Info("Lifted the fence, the old copy may register again")
+	}
+
+	return nil
+}
+
+func (c *Control) fencedContainersImpl(args *FencedContainersArgs, reply interface{}) error {
+	ranks, ok := reply.(*[]container.Rank)
+	if !ok {
+		return fmt.Errorf("Failed to parse reply parameter")
+	}
+
+	*ranks = c.fences.Ranks(Location{args.Hostname})
+	return nil
+}
@@ -0,0 +1,83 @@
+package coordinator
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/config"
+	. "github.com/planetA/konk/pkg/coordinator"
+)
+
+const (
+	defaultSuspectTimeout = 5 * time.Second
+	defaultDeadTimeout    = 15 * time.Second
+)
+
+// Internal request to recompute liveness of nymphs
+type livenessCheckArgs struct {
+}
+
+func getTimeout(key config.ViperKey, defaultTimeout time.Duration) time.Duration {
+	if seconds, ok := config.GetIntOk(key); ok {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return defaultTimeout
+}
+
+// Same as getTimeout, but a timeout, that is not positive, falls back to the default
+func getPositiveTimeout(key config.ViperKey, defaultTimeout time.Duration) time.Duration {
+	if timeout := getTimeout(key, defaultTimeout); timeout > 0 {
+		return timeout
+	}
+
+	log.WithField("key", key).Warn("Timeout must be positive, using the default")
+	return defaultTimeout
+}
+
+// Heartbeats do not go through the request queue, otherwise a long migration would delay
+// them and make the nymphs look dead.
+func (c *Control) Heartbeat(args *HeartbeatArgs) error {
+	if !c.nymphSet.Heartbeat(Location{args.Hostname}, args.Metrics) {
+		return fmt.Errorf("Nymph %v is not registered", args.Hostname)
+	}
+
+	return nil
+}
+
+// Periodically ask the control loop to check, which nymphs have stopped sending heartbeats
+func (c *Control) MonitorLiveness() {
+	suspectTimeout := getPositiveTimeout(config.CoordinatorSuspectTimeout, defaultSuspectTimeout)
+
+	ticker := time.NewTicker(suspectTimeout / 2)
+	for range ticker.C {
+		if err := c.Request(&livenessCheckArgs{}); err != nil {
+			log.WithError(err).Error("Liveness check failed")
+		}
+	}
+}
+
+func (c *Control) livenessCheckImpl() error {
+	suspectTimeout := getPositiveTimeout(config.CoordinatorSuspectTimeout, defaultSuspectTimeout)
+	deadTimeout := getPositiveTimeout(config.CoordinatorDeadTimeout, defaultDeadTimeout)
+
+	for _, location := range c.nymphSet.UpdateLiveness(suspectTimeout, deadTimeout) {
+		ranks := c.locationDB.Ranks(location)
+
+		log.WithFields(log.Fields{
+			"nymph": location.Hostname,
+			"ranks": ranks,
+		}).Warn("Nymph is dead, dropping its containers")
+
+		for _, rank := range ranks {
+			c.locationDB.Unset(rank, location)
+			c.record(StateEvent{Type: EventUnregisterContainer, Rank: rank, Hostname: location.Hostname})
+		}
+
+		c.restartRanks(location, ranks)
+	}
+
+	return nil
+}
@@ -65,21 +65,38 @@ func (l *LocationDB) LocationsStat() map[Location]LocationInfo {
 	infoMap := make(map[Location]LocationInfo)
 
 	for _, location := range l.db {
-		if info, ok := infoMap[location]; ok != true {
-			infoMap[location] = LocationInfo{
-				ContainerCount: 1,
-			}
-		} else {
-			info.ContainerCount = info.ContainerCount + 1
-		}
+		info := infoMap[location]
+		info.ContainerCount = info.ContainerCount + 1
+		infoMap[location] = info
 	}
 
 	return infoMap
 }
 
-func (l *LocationDB) Dump() LocationDB {
+// Return ranks located at the given location
+func (l *LocationDB) Ranks(location Location) []container.Rank {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	return *l
+	ranks := make([]container.Rank, 0)
+	for rank, loc := range l.db {
+		if loc == location {
+			ranks = append(ranks, rank)
+		}
+	}
+
+	return ranks
+}
+
+// Return a copy of the rank locations
+func (l *LocationDB) Copy() map[container.Rank]Location {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	db := make(map[container.Rank]Location, len(l.db))
+	for rank, location := range l.db {
+		db[rank] = location
+	}
+
+	return db
 }
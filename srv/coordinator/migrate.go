@@ -15,34 +15,47 @@ import (
 // checkpoint. The nymph returns the port number that should be used specifically for transferring
 // this particular checkpoint. Then, the coordinator contacts the source nymph, tells it the
 // destination hostname and port number, and asks to send the checkpoint.
-func Migrate(containerRank container.Rank, srcHost, destHost string, migrationType container.MigrationType) error {
+func Migrate(id uint64, containerRank container.Rank, srcHost, destHost string, migrationType container.MigrationType, opts container.MigrationOpts) (*nymph.SendReply, error) {
 	if srcHost == destHost {
-		return fmt.Errorf("The container is already at the destination")
+		return nil, fmt.Errorf("The container is already at the destination")
 	}
 
 	// Tell the nymph to migrate the container to another nymph
 	donorClient, err := nymph.NewClient(srcHost)
 	if err != nil {
-		return fmt.Errorf("Failed to reach nymph: %v", err)
+		return nil, fmt.Errorf("Failed to reach nymph: %v", err)
 	}
 	defer donorClient.Close()
 
 	log.WithFields(log.Fields{
+		"id":   id,
 		"rank": containerRank,
 		"src":  srcHost,
 		"dst":  destHost,
 		"type": migrationType,
+		"opts": opts,
 	}).Trace("Requesting migration")
 
 	start := time.Now()
-	err = donorClient.Send(containerRank, destHost, migrationType)
+	reply, err := donorClient.Send(id, containerRank, destHost, migrationType, opts)
 	if err != nil {
-		return fmt.Errorf("Container did not migrate: %v", err)
+		return nil, fmt.Errorf("Container did not migrate: %v", err)
 	}
 
-	log.WithField("elapsed", time.Since(start)).Info("Migration finished successfully")
+	if reply.RolledBack {
+		log.WithFields(log.Fields{
+			"elapsed": time.Since(start),
+			"error":   reply.Error,
+		}).Warn("Migration has been rolled back")
+		return reply, nil
+	}
 
-	return nil
+	log.WithFields(log.Fields{
+		"elapsed": time.Since(start),
+		"dumps":   len(reply.Dumps),
+	}).Info("Migration finished successfully")
+
+	return reply, nil
 }
 
 func Signal(containerRank container.Rank, host string, signal syscall.Signal) error {
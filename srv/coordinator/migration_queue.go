@@ -0,0 +1,299 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/config"
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/coordinator"
+)
+
+const (
+	// Number of migrations running at the same time, if not configured
+	defaultMigrationConcurrency = 4
+	// Number of finished migrations, whose status is kept
+	maxFinishedMigrations = 64
+)
+
+// A migration waiting in the queue or running
+type migrationJob struct {
+	args  *MigrateArgs
+	reply *MigrateReply
+	done  chan error
+
+	// Protected by the mutex of the queue
+	status MigrationStatus
+}
+
+// Enter the next phase of the migration. Must be called with the queue mutex held.
+func (job *migrationJob) setPhase(phase MigrationPhase) {
+	now := time.Now()
+
+	if count := len(job.status.Phases); count > 0 {
+		last := &job.status.Phases[count-1]
+		last.Elapsed = now.Sub(last.Start)
+	}
+
+	job.status.Phase = phase
+	if !phase.Final() {
+		job.status.Phases = append(job.status.Phases, PhaseTiming{
+			Phase: phase,
+			Start: now,
+		})
+	}
+}
+
+// Copy of the status, that does not share the phases. Must be called with the queue mutex held.
+func (job *migrationJob) copyStatus() MigrationStatus {
+	status := job.status
+	status.Phases = append([]PhaseTiming(nil), job.status.Phases...)
+
+	// The current phase is still going on
+	if count := len(status.Phases); count > 0 && !status.Phase.Final() {
+		last := &status.Phases[count-1]
+		last.Elapsed = time.Since(last.Start)
+	}
+
+	return status
+}
+
+// Migrations are executed outside of the control loop, so that a long migration does not
+// hold up other requests. At most concurrency migrations run at a time, and a rank never
+// migrates twice at once. Migrations of a rank start in the order they were submitted.
+type migrationQueue struct {
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	nextID      uint64
+	pending     []*migrationJob
+	running     map[container.Rank]*migrationJob
+	finished    []*migrationJob
+	concurrency int
+}
+
+func newMigrationQueue() *migrationQueue {
+	concurrency, ok := config.GetIntOk(config.CoordinatorMigrationConcurrency)
+	if !ok || concurrency <= 0 {
+		concurrency = defaultMigrationConcurrency
+	}
+
+	queue := &migrationQueue{
+		nextID:      1,
+		pending:     make([]*migrationJob, 0),
+		running:     make(map[container.Rank]*migrationJob),
+		finished:    make([]*migrationJob, 0),
+		concurrency: concurrency,
+	}
+	queue.cond = sync.NewCond(&queue.mutex)
+
+	return queue
+}
+
+// Put a migration into the queue. The result is delivered to the done channel of the job.
+func (q *migrationQueue) Submit(args *MigrateArgs, reply *MigrateReply) *migrationJob {
+	if reply == nil {
+		reply = &MigrateReply{}
+	}
+
+	job := &migrationJob{
+		args:  args,
+		reply: reply,
+		done:  make(chan error, 1),
+	}
+
+	q.mutex.Lock()
+	job.status = MigrationStatus{
+		ID:            q.nextID,
+		Rank:          args.Rank,
+		Dest:          args.DestHost,
+		MigrationType: args.MigrationType,
+		Submitted:     time.Now(),
+	}
+	job.setPhase(PhaseQueued)
+	q.nextID++
+
+	reply.ID = job.status.ID
+	q.pending = append(q.pending, job)
+	log.WithFields(log.Fields{
+		"id":      job.status.ID,
+		"rank":    args.Rank,
+		"pending": len(q.pending),
+		"running": len(q.running),
+	}).Debug("Migration has been queued")
+	q.mutex.Unlock()
+
+	q.cond.Broadcast()
+
+	return job
+}
+
+// Check, if the rank has a migration queued or running
+func (q *migrationQueue) Busy(rank container.Rank) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.running[rank]; ok {
+		return true
+	}
+
+	for _, job := range q.pending {
+		if job.args.Rank == rank {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Wait for a queued migration, whose rank is not migrating already, and mark it as running
+func (q *migrationQueue) next() *migrationJob {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		for i, job := range q.pending {
+			if _, ok := q.running[job.args.Rank]; ok {
+				continue
+			}
+
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			q.running[job.args.Rank] = job
+			return job
+		}
+
+		q.cond.Wait()
+	}
+}
+
+func (q *migrationQueue) finish(job *migrationJob, err error) {
+	q.mutex.Lock()
+	delete(q.running, job.args.Rank)
+
+	switch {
+	case err != nil:
+		job.status.Error = err.Error()
+		job.setPhase(PhaseFailed)
+	case job.reply.RolledBack:
+		job.status.Error = job.reply.Error
+		job.setPhase(PhaseRolledBack)
+	default:
+		job.setPhase(PhaseDone)
+	}
+
+	q.finished = append(q.finished, job)
+	if len(q.finished) > maxFinishedMigrations {
+		q.finished = q.finished[len(q.finished)-maxFinishedMigrations:]
+	}
+	q.mutex.Unlock()
+
+	q.cond.Broadcast()
+
+	job.done <- err
+}
+
+// Remember the source of a running migration, once it is known
+func (q *migrationQueue) setSource(job *migrationJob, src Location) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job.status.Src = src.Hostname
+}
+
+// Update a running migration with a report of a nymph
+func (q *migrationQueue) Progress(args *MigrationProgressArgs) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, job := range q.running {
+		if job.status.ID != args.ID {
+			continue
+		}
+
+		if args.Phase != "" && args.Phase != job.status.Phase && !args.Phase.Final() {
+			job.setPhase(args.Phase)
+		}
+
+		// Reports about other phases carry no transfer state
+		if args.BytesTotal > 0 {
+			job.status.BytesSent = args.BytesSent
+			job.status.BytesTotal = args.BytesTotal
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Migration %v is not running", args.ID)
+}
+
+func (q *migrationQueue) Status(id uint64) (MigrationStatus, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, job := range q.jobs(true) {
+		if job.status.ID == id {
+			return job.copyStatus(), true
+		}
+	}
+
+	return MigrationStatus{}, false
+}
+
+// Status of migrations ordered by ID. Finished ones are included with all.
+func (q *migrationQueue) List(all bool) []MigrationStatus {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	jobs := q.jobs(all)
+	statuses := make([]MigrationStatus, 0, len(jobs))
+	for _, job := range jobs {
+		statuses = append(statuses, job.copyStatus())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+
+	return statuses
+}
+
+// Must be called with the mutex held
+func (q *migrationQueue) jobs(all bool) []*migrationJob {
+	jobs := make([]*migrationJob, 0, len(q.pending)+len(q.running)+len(q.finished))
+	jobs = append(jobs, q.pending...)
+	for _, job := range q.running {
+		jobs = append(jobs, job)
+	}
+	if all {
+		jobs = append(jobs, q.finished...)
+	}
+
+	return jobs
+}
+
+// Execute queued migrations with a fixed number of workers
+func (c *Control) runMigrations() {
+	for i := 0; i < c.migrations.concurrency; i++ {
+		go func() {
+			for {
+				job := c.migrations.next()
+				err := c.migrateImpl(job)
+				c.migrations.finish(job, err)
+			}
+		}()
+	}
+}
+
+// Queue a migration. Unless the request is detached, wait for the migration to finish.
+// A detached migration fills its own reply, because the reply of the caller is sent right away.
+func (c *Control) Migrate(args *MigrateArgs, reply *MigrateReply) error {
+	if args.Detach {
+		job := c.migrations.Submit(args, nil)
+		reply.ID = job.reply.ID
+		return nil
+	}
+
+	job := c.migrations.Submit(args, reply)
+	return <-job.done
+}
@@ -0,0 +1,96 @@
+package coordinator
+
+import (
+	"net"
+	"net/rpc"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/ugorji/go/codec"
+
+	"github.com/planetA/konk/config"
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/coordinator"
+	"github.com/planetA/konk/pkg/nymph"
+)
+
+// Donor nymph, that takes its time and then rolls the migration back
+type rollbackNymph struct{}
+
+func (n *rollbackNymph) Send(args nymph.SendArgs, reply *nymph.SendReply) error {
+	time.Sleep(100 * time.Millisecond)
+
+	reply.Dumps = []container.DumpStats{{}}
+	reply.RolledBack = true
+	reply.Error = "Recipient has gone"
+
+	return nil
+}
+
+// Serve the nymph at the nymph port of a local address
+func startTestNymph(t *testing.T, rcvr interface{}) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Nymph", rcvr); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set(string(config.NymphPort), strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+
+	go func() {
+		var handle codec.MsgpackHandle
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go server.ServeCodec(codec.MsgpackSpecRpc.ServerCodec(conn, &handle))
+		}
+	}()
+}
+
+func TestDetachedMigrate(t *testing.T) {
+	startTestNymph(t, &rollbackNymph{})
+
+	c := newTestControl(map[string]NymphMetrics{"127.0.0.1": {}, "localhost": {}})
+	c.locationDB.Set(0, Location{"127.0.0.1"})
+	c.runMigrations()
+
+	reply := &MigrateReply{}
+	if err := c.Migrate(&MigrateArgs{Rank: 0, DestHost: "localhost", MigrationType: container.Migrate, Detach: true}, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reply is sent back to the caller, while the migration is still running
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sent := *reply
+		if sent.ID == 0 || sent.Dumps != nil || sent.RolledBack || sent.Error != "" {
+			t.Fatalf("Detached reply must carry only the ID, got %+v", sent)
+		}
+
+		status, ok := c.migrations.Status(sent.ID)
+		if !ok {
+			t.Fatalf("Migration %v is not known", sent.ID)
+		}
+
+		if status.Phase.Final() {
+			if status.Phase != PhaseRolledBack || status.Error != "Recipient has gone" {
+				t.Errorf("Expected the migration to be rolled back, got %+v", status)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Migration did not finish, still %v", status.Phase)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -2,51 +2,176 @@ package coordinator
 
 import (
 	"sync"
+	"time"
 
 	"github.com/willf/bitset"
+
+	. "github.com/planetA/konk/pkg/coordinator"
+)
+
+// Liveness of a nymph as seen by the coordinator
+type Liveness int
+
+const (
+	Alive Liveness = iota
+	// Heartbeats are late, the nymph is not used for new containers
+	Suspect
+	// Heartbeats have stopped, the containers of the nymph are considered lost
+	Dead
 )
 
+func (l Liveness) String() string {
+	switch l {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	default:
+		panic("Unreachable")
+	}
+}
+
+type nymphEntry struct {
+	id       uint
+	lastSeen time.Time
+	liveness Liveness
+	metrics  NymphMetrics
+	// Number of evacuations in progress. A draining nymph takes no new containers.
+	draining int
+}
+
 type NymphSet struct {
 	activeIds bitset.BitSet
-	set       map[Location]uint
+	set       map[Location]*nymphEntry
 	mutex     sync.Mutex
 }
 
 func NewNymphSet() *NymphSet {
 	return &NymphSet{
-		set:       make(map[Location]uint),
-		mutex:     sync.Mutex{},
+		set:   make(map[Location]*nymphEntry),
+		mutex: sync.Mutex{},
 	}
 }
 
+// Add a nymph. If the nymph is known already, it keeps its ID and becomes alive again.
 func (n *NymphSet) Add(location Location) uint {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
+	if entry, ok := n.set[location]; ok {
+		entry.lastSeen = time.Now()
+		entry.liveness = Alive
+		return entry.id
+	}
+
 	id, ok := n.activeIds.NextClear(0)
 	if ok != true {
 		id = n.activeIds.Count()
 	}
 
 	n.activeIds.Set(id)
-	n.set[location] = id
+	n.set[location] = &nymphEntry{
+		id:       id,
+		lastSeen: time.Now(),
+		liveness: Alive,
+	}
 	return id
 }
 
+// Add the nymph with an ID, that was allocated earlier
+func (n *NymphSet) AddWithId(location Location, id uint) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if entry, ok := n.set[location]; ok {
+		n.activeIds.Clear(entry.id)
+	}
+
+	n.activeIds.Set(id)
+	n.set[location] = &nymphEntry{
+		id:       id,
+		lastSeen: time.Now(),
+		liveness: Alive,
+	}
+}
+
 func (n *NymphSet) Del(location Location) bool {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
-	id, ok := n.set[location]
+	entry, ok := n.set[location]
 	if !ok {
 		return false
 	}
 
-	n.activeIds.Clear(id)
+	n.activeIds.Clear(entry.id)
 	delete(n.set, location)
 	return true
 }
 
+// Record a heartbeat from the nymph together with the resources it reported. Returns
+// false, if the nymph is not registered or has been declared dead.
+func (n *NymphSet) Heartbeat(location Location, metrics NymphMetrics) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	entry, ok := n.set[location]
+	if !ok || entry.liveness == Dead {
+		return false
+	}
+
+	entry.lastSeen = time.Now()
+	entry.liveness = Alive
+	entry.metrics = metrics
+	return true
+}
+
+// Recompute liveness of all nymphs. Returns the nymphs, that have just been declared dead.
+func (n *NymphSet) UpdateLiveness(suspectAfter, deadAfter time.Duration) []Location {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	died := make([]Location, 0)
+	now := time.Now()
+	for location, entry := range n.set {
+		if entry.liveness == Dead {
+			continue
+		}
+
+		silence := now.Sub(entry.lastSeen)
+		switch {
+		case silence > deadAfter:
+			entry.liveness = Dead
+			died = append(died, location)
+		case silence > suspectAfter:
+			entry.liveness = Suspect
+		default:
+			entry.liveness = Alive
+		}
+	}
+
+	return died
+}
+
+func (n *NymphSet) Liveness(location Location) (Liveness, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	entry, ok := n.set[location]
+	if !ok {
+		return Dead, false
+	}
+
+	return entry.liveness, true
+}
+
+func (n *NymphSet) IsAlive(location Location) bool {
+	liveness, ok := n.Liveness(location)
+	return ok && liveness == Alive
+}
+
 func (n *NymphSet) GetNymphs() []Location {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
@@ -60,3 +185,90 @@ func (n *NymphSet) GetNymphs() []Location {
 
 	return nymphs
 }
+
+// Return only the nymphs, that are alive
+func (n *NymphSet) GetAliveNymphs() []Location {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	nymphs := make([]Location, 0, len(n.set))
+	for nymph, entry := range n.set {
+		if entry.liveness == Alive {
+			nymphs = append(nymphs, nymph)
+		}
+	}
+
+	return nymphs
+}
+
+// Return the alive nymphs, that are not draining. Only these nymphs take new containers.
+func (n *NymphSet) GetSchedulableNymphs() []Location {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	nymphs := make([]Location, 0, len(n.set))
+	for nymph, entry := range n.set {
+		if entry.liveness == Alive && entry.draining == 0 {
+			nymphs = append(nymphs, nymph)
+		}
+	}
+
+	return nymphs
+}
+
+func (n *NymphSet) IsSchedulable(location Location) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	entry, ok := n.set[location]
+	return ok && entry.liveness == Alive && entry.draining == 0
+}
+
+// Stop placing containers at the nymph until the matching Undrain. Returns false, if the
+// nymph is not known.
+func (n *NymphSet) Drain(location Location) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	entry, ok := n.set[location]
+	if !ok {
+		return false
+	}
+
+	entry.draining++
+	return true
+}
+
+func (n *NymphSet) Undrain(location Location) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if entry, ok := n.set[location]; ok && entry.draining > 0 {
+		entry.draining--
+	}
+}
+
+func (n *NymphSet) GetNymphIds() map[Location]uint {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	ids := make(map[Location]uint, len(n.set))
+	for nymph, entry := range n.set {
+		ids[nymph] = entry.id
+	}
+
+	return ids
+}
+
+// Last resources reported by every nymph
+func (n *NymphSet) GetMetrics() map[Location]NymphMetrics {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	metrics := make(map[Location]NymphMetrics, len(n.set))
+	for nymph, entry := range n.set {
+		metrics[nymph] = entry.metrics
+	}
+
+	return metrics
+}
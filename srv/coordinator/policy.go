@@ -0,0 +1,181 @@
+package coordinator
+
+import (
+	"math/rand"
+
+	"github.com/planetA/konk/config"
+	"github.com/planetA/konk/pkg/container"
+)
+
+func init() {
+	RegisterScheduler("none", func() Scheduler { return &noneScheduler{} })
+	RegisterScheduler("random", func() Scheduler { return &randomScheduler{} })
+	RegisterScheduler("load-balance", func() Scheduler { return &loadBalanceScheduler{} })
+	RegisterScheduler("consolidate", func() Scheduler {
+		maxPerNymph, _ := config.GetIntOk(config.CoordinatorSchedulerMaxPerNymph)
+		return &consolidateScheduler{maxPerNymph: maxPerNymph}
+	})
+	RegisterScheduler("round-robin", func() Scheduler { return &roundRobinScheduler{} })
+}
+
+// Never migrates anything
+type noneScheduler struct {
+}
+
+func (s *noneScheduler) Schedule(snapshot *Snapshot) []Decision {
+	return nil
+}
+
+// Migrates a random rank to a random nymph, once the number of ranks is stable
+type randomScheduler struct {
+	lastLen int
+}
+
+func (s *randomScheduler) Schedule(snapshot *Snapshot) []Decision {
+	ranks := snapshot.Ranks()
+
+	curLen := len(ranks)
+	if !(curLen > 0 && s.lastLen == curLen) {
+		s.lastLen = curLen
+		return nil
+	}
+	s.lastLen = curLen
+
+	if len(snapshot.Nymphs) < 2 {
+		return nil
+	}
+
+	// Pick a random container
+	targetCont := ranks[rand.Intn(len(ranks))]
+	srcLoc := snapshot.Locations[targetCont]
+
+	// Pick a target location other than the source
+	locs := make([]Location, 0, len(snapshot.Nymphs))
+	for _, loc := range snapshot.Nymphs {
+		if loc != srcLoc {
+			locs = append(locs, loc)
+		}
+	}
+	if len(locs) == 0 {
+		return nil
+	}
+
+	return []Decision{{
+		Rank:          targetCont,
+		Dest:          locs[rand.Intn(len(locs))],
+		MigrationType: container.Migrate,
+	}}
+}
+
+// Moves a rank from the most loaded nymph to the least loaded one, until the number of
+// ranks differs by at most one.
+type loadBalanceScheduler struct {
+}
+
+func (s *loadBalanceScheduler) Schedule(snapshot *Snapshot) []Decision {
+	if len(snapshot.Nymphs) < 2 {
+		return nil
+	}
+
+	perNymph := snapshot.RanksPerNymph()
+
+	maxLoc, minLoc := snapshot.Nymphs[0], snapshot.Nymphs[0]
+	for _, loc := range snapshot.Nymphs {
+		if len(perNymph[loc]) > len(perNymph[maxLoc]) {
+			maxLoc = loc
+		}
+		if len(perNymph[loc]) < len(perNymph[minLoc]) {
+			minLoc = loc
+		}
+	}
+
+	if len(perNymph[maxLoc])-len(perNymph[minLoc]) < 2 {
+		return nil
+	}
+
+	return []Decision{{
+		Rank:          perNymph[maxLoc][0],
+		Dest:          minLoc,
+		MigrationType: container.Migrate,
+	}}
+}
+
+// Packs ranks onto as few nymphs as possible. Moves a rank from the least loaded nymph to
+// the most loaded one, that still has room. Zero maxPerNymph means no limit.
+type consolidateScheduler struct {
+	maxPerNymph int
+}
+
+func (s *consolidateScheduler) hasRoom(count int) bool {
+	return s.maxPerNymph <= 0 || count < s.maxPerNymph
+}
+
+func (s *consolidateScheduler) Schedule(snapshot *Snapshot) []Decision {
+	perNymph := snapshot.RanksPerNymph()
+
+	var src, dest *Location
+	for i := range snapshot.Nymphs {
+		loc := &snapshot.Nymphs[i]
+		count := len(perNymph[*loc])
+		if count == 0 {
+			continue
+		}
+
+		if src == nil || count < len(perNymph[*src]) {
+			src = loc
+		}
+	}
+
+	if src == nil {
+		return nil
+	}
+
+	for i := range snapshot.Nymphs {
+		loc := &snapshot.Nymphs[i]
+		count := len(perNymph[*loc])
+		if *loc == *src || count < len(perNymph[*src]) || !s.hasRoom(count) {
+			continue
+		}
+
+		if dest == nil || count > len(perNymph[*dest]) {
+			dest = loc
+		}
+	}
+
+	if dest == nil {
+		return nil
+	}
+
+	return []Decision{{
+		Rank:          perNymph[*src][0],
+		Dest:          *dest,
+		MigrationType: container.Migrate,
+	}}
+}
+
+// Places ranks on nymphs in round-robin fashion: i-th rank goes to the nymph number
+// i modulo the number of nymphs.
+type roundRobinScheduler struct {
+}
+
+func (s *roundRobinScheduler) Schedule(snapshot *Snapshot) []Decision {
+	if len(snapshot.Nymphs) == 0 {
+		return nil
+	}
+
+	decisions := make([]Decision, 0)
+	for i, rank := range snapshot.Ranks() {
+		target := snapshot.Nymphs[i%len(snapshot.Nymphs)]
+		if snapshot.Locations[rank] == target {
+			continue
+		}
+
+		decisions = append(decisions, Decision{
+			Rank:          rank,
+			Dest:          target,
+			MigrationType: container.Migrate,
+		})
+	}
+
+	return decisions
+}
@@ -0,0 +1,94 @@
+package coordinator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/planetA/konk/pkg/container"
+)
+
+// Snapshot of the alive nymphs, where rank i runs at hosts[i]
+func snapshotOf(nymphs []string, hosts ...string) *Snapshot {
+	snapshot := &Snapshot{
+		Locations: make(map[container.Rank]Location),
+	}
+
+	for rank, host := range hosts {
+		snapshot.Locations[container.Rank(rank)] = Location{host}
+	}
+
+	for _, nymph := range nymphs {
+		snapshot.Nymphs = append(snapshot.Nymphs, Location{nymph})
+	}
+
+	return snapshot
+}
+
+func TestSchedulers(t *testing.T) {
+	ab := []string{"a", "b"}
+	abc := []string{"a", "b", "c"}
+	move := func(rank container.Rank, host string) []Decision {
+		return []Decision{{Rank: rank, Dest: Location{host}, MigrationType: container.Migrate}}
+	}
+
+	tests := map[string]struct {
+		scheduler Scheduler
+		snapshot  *Snapshot
+		expected  []Decision
+	}{
+		"none":                       {&noneScheduler{}, snapshotOf(ab, "a", "a", "a"), nil},
+		"load-balance, one nymph":    {&loadBalanceScheduler{}, snapshotOf([]string{"a"}, "a", "a"), nil},
+		"load-balance, balanced":     {&loadBalanceScheduler{}, snapshotOf(ab, "a", "a", "b"), nil},
+		"load-balance, overloaded":   {&loadBalanceScheduler{}, snapshotOf(ab, "a", "a", "a"), move(0, "b")},
+		"load-balance, empty nymph":  {&loadBalanceScheduler{}, snapshotOf(abc, "a", "a", "b", "b"), move(0, "c")},
+		"load-balance, gone nymph":   {&loadBalanceScheduler{}, snapshotOf(ab, "x", "x", "x"), nil},
+		"consolidate":                {&consolidateScheduler{}, snapshotOf(ab, "a", "b", "b"), move(0, "b")},
+		"consolidate, packed":        {&consolidateScheduler{}, snapshotOf(ab, "a", "a"), nil},
+		"consolidate, full":          {&consolidateScheduler{maxPerNymph: 2}, snapshotOf(ab, "a", "b", "b"), nil},
+		"consolidate, room left":     {&consolidateScheduler{maxPerNymph: 3}, snapshotOf(abc, "a", "b", "b", "c", "c", "c"), move(0, "b")},
+		"round-robin, no nymphs":     {&roundRobinScheduler{}, snapshotOf(nil, "a"), nil},
+		"round-robin, spread":        {&roundRobinScheduler{}, snapshotOf(ab, "a", "a", "a", "b"), move(1, "b")},
+		"round-robin, already there": {&roundRobinScheduler{}, snapshotOf(abc, "a", "b", "c", "a"), nil},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			decisions := test.scheduler.Schedule(test.snapshot)
+			if len(decisions) == 0 && len(test.expected) == 0 {
+				return
+			}
+
+			if !reflect.DeepEqual(decisions, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, decisions)
+			}
+		})
+	}
+}
+
+// The random policy waits for the number of ranks to settle, then moves one rank elsewhere
+func TestRandomScheduler(t *testing.T) {
+	scheduler := &randomScheduler{}
+	snapshot := snapshotOf([]string{"a", "b", "c"}, "a", "a", "b")
+
+	if decisions := scheduler.Schedule(snapshot); len(decisions) != 0 {
+		t.Fatalf("Ranks are not stable yet, got %v", decisions)
+	}
+
+	for i := 0; i < 20; i++ {
+		decisions := scheduler.Schedule(snapshot)
+		if len(decisions) != 1 {
+			t.Fatalf("Expected a single decision, got %v", decisions)
+		}
+
+		src, ok := snapshot.Locations[decisions[0].Rank]
+		if !ok || decisions[0].Dest == src || decisions[0].Dest.Hostname == "" {
+			t.Errorf("Bad decision %v for ranks %v", decisions[0], snapshot.Locations)
+		}
+	}
+
+	single := snapshotOf([]string{"a"}, "a")
+	scheduler.Schedule(single)
+	if decisions := scheduler.Schedule(single); len(decisions) != 0 {
+		t.Errorf("A single nymph leaves nowhere to go, got %v", decisions)
+	}
+}
@@ -0,0 +1,165 @@
+package coordinator
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+	"github.com/planetA/konk/pkg/nymph"
+)
+
+// Persist a change of the state. The in-memory state stays authoritative, so a failure
+// to persist is only reported.
+func (c *Control) record(event StateEvent) {
+	if err := c.store.Append(event); err != nil {
+		log.WithError(err).WithField("event", event).Error("Failed to persist coordinator state")
+	}
+}
+
+func (c *Control) applyEvent(event StateEvent) error {
+	location := Location{event.Hostname}
+
+	switch event.Type {
+	case EventRegisterContainer, EventMigrateContainer:
+		c.locationDB.Set(event.Rank, location)
+	case EventUnregisterContainer:
+		c.locationDB.Unset(event.Rank, location)
+	case EventRegisterNymph:
+		c.nymphSet.AddWithId(location, event.NymphId)
+	case EventUnregisterNymph:
+		c.nymphSet.Del(location)
+	case EventCheckpoint:
+		if event.Image == nil {
+			return fmt.Errorf("Checkpoint of rank %v has no image info", event.Rank)
+		}
+		c.checkpoints.Set(event.Rank, checkpointRecord{
+			location: location,
+			image:    *event.Image,
+			dir:      event.Dir,
+			replicas: event.Replicas,
+		})
+	case EventDropCheckpoint:
+		c.checkpoints.Del(event.Rank)
+	case EventFence:
+		c.fences.Add(location, event.Rank)
+	case EventUnfence:
+		c.fences.Del(location, event.Rank)
+	default:
+		return fmt.Errorf("Unknown state event: %v", event.Type)
+	}
+
+	return nil
+}
+
+// Current state in the form of events, that recreate the state
+func (c *Control) snapshot() []StateEvent {
+	events := make([]StateEvent, 0)
+
+	for location, id := range c.nymphSet.GetNymphIds() {
+		events = append(events, StateEvent{
+			Type:     EventRegisterNymph,
+			Hostname: location.Hostname,
+			NymphId:  id,
+		})
+	}
+
+	for rank, location := range c.locationDB.Copy() {
+		events = append(events, StateEvent{
+			Type:     EventRegisterContainer,
+			Rank:     rank,
+			Hostname: location.Hostname,
+		})
+	}
+
+	for location, ranks := range c.fences.fences {
+		for rank := range ranks {
+			events = append(events, StateEvent{
+				Type:     EventFence,
+				Rank:     rank,
+				Hostname: location.Hostname,
+			})
+		}
+	}
+
+	for rank, record := range c.checkpoints.records {
+		image := record.image
+		events = append(events, StateEvent{
+			Type:     EventCheckpoint,
+			Rank:     rank,
+			Hostname: record.location.Hostname,
+			Image:    &image,
+			Dir:      record.dir,
+			Replicas: record.replicas,
+		})
+	}
+
+	return events
+}
+
+// Replay the persisted state. Must be called before the control loop starts.
+func (c *Control) Restore() error {
+	if err := c.store.Replay(c.applyEvent); err != nil {
+		return fmt.Errorf("Failed to replay coordinator state: %v", err)
+	}
+
+	log.WithFields(log.Fields{
+		"nymphs":     c.nymphSet.GetNymphs(),
+		"containers": c.locationDB.Copy(),
+	}).Info("Restored coordinator state")
+
+	return c.store.Compact(c.snapshot())
+}
+
+func queryNymph(location Location) ([]container.Rank, error) {
+	client, err := nymph.NewClientOnce(location.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return client.ListContainers()
+}
+
+// Ask every known nymph, what containers it actually runs, and fix the state accordingly.
+// Nymphs, that cannot be reached, keep their containers. If they do not send heartbeats
+// either, the liveness check declares them dead and restarts their containers from the
+// checkpoints. Must be called before the control loop starts.
+func (c *Control) Reconcile() {
+	for _, location := range c.nymphSet.GetNymphs() {
+		ranks, err := queryNymph(location)
+		if err != nil {
+			log.WithError(err).WithField("nymph", location.Hostname).Warn("Nymph is not reachable, waiting for its heartbeat")
+			continue
+		}
+
+		running := make(map[container.Rank]bool)
+		for _, rank := range ranks {
+			running[rank] = true
+
+			if cur, ok := c.locationDB.Get(rank); ok && cur == location {
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"rank":  rank,
+				"nymph": location.Hostname,
+			}).Info("Found unknown container")
+			c.locationDB.Set(rank, location)
+			c.record(StateEvent{Type: EventRegisterContainer, Rank: rank, Hostname: location.Hostname})
+		}
+
+		for _, rank := range c.locationDB.Ranks(location) {
+			if running[rank] {
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"rank":  rank,
+				"nymph": location.Hostname,
+			}).Info("Container is not running anymore")
+			c.locationDB.Unset(rank, location)
+			c.record(StateEvent{Type: EventUnregisterContainer, Rank: rank, Hostname: location.Hostname})
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package coordinator
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/config"
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/coordinator"
+	"github.com/planetA/konk/pkg/nymph"
+)
+
+const (
+	defaultRestartAttempts = 3
+	defaultRestartDelay    = 5 * time.Second
+)
+
+// Ranks, that are being restarted from their checkpoints
+type restarts struct {
+	mutex   sync.Mutex
+	pending map[container.Rank]bool
+}
+
+func newRestarts() *restarts {
+	return &restarts{
+		pending: make(map[container.Rank]bool),
+	}
+}
+
+func (r *restarts) start(rank container.Rank) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.pending[rank] {
+		return false
+	}
+
+	r.pending[rank] = true
+	return true
+}
+
+func (r *restarts) finish(rank container.Rank) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.pending, rank)
+}
+
+// Restart the ranks of a dead nymph from their latest stored or replicated checkpoints.
+// Ranks without such a checkpoint are lost. Must be called from the control loop.
+func (c *Control) restartRanks(dead Location, ranks []container.Rank) {
+	attempts := defaultRestartAttempts
+	if value, ok := config.GetIntOk(config.CoordinatorRestartAttempts); ok {
+		attempts = value
+	}
+
+	if attempts <= 0 && len(ranks) > 0 {
+		log.WithFields(log.Fields{
+			"nymph": dead.Hostname,
+			"ranks": ranks,
+		}).Warn("Automatic restart is disabled, ranks are lost")
+		return
+	}
+
+	for _, rank := range ranks {
+		record, ok := c.checkpoints.Get(rank)
+		if !ok || !record.durable() {
+			log.WithFields(log.Fields{
+				"rank":  rank,
+				"nymph": dead.Hostname,
+			}).Warn("Rank has no stored or replicated checkpoint and is lost")
+			continue
+		}
+
+		if !c.restarts.start(rank) {
+			continue
+		}
+
+		// The old copy might still run, if the nymph has only been cut off
+		c.fence(dead, rank)
+
+		go func(rank container.Rank, record checkpointRecord) {
+			defer c.restarts.finish(rank)
+			if !c.restartRank(rank, record, attempts) {
+				c.Request(&unfenceArgs{rank: rank, location: dead})
+			}
+		}(rank, record)
+	}
+}
+
+func restoreReplicaAt(hostname string, image container.ImageInfoArgs) error {
+	client, err := nymph.NewClientOnce(hostname)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.RestoreReplica(image)
+}
+
+// Restore the rank from the storage directory at a nymph chosen by the allocation policy,
+// or from a replica at a surviving buddy
+func (c *Control) restoreCheckpoint(rank container.Rank, record checkpointRecord) error {
+	var err error
+	if record.dir != "" {
+		var hostname string
+		if err = c.RequestReply(&AllocateHostArgs{Rank: rank}, &hostname); err == nil {
+			log.WithFields(log.Fields{
+				"rank":       rank,
+				"nymph":      hostname,
+				"generation": record.image.Generation,
+			}).Info("Restarting rank from its stored checkpoint")
+
+			if err = restoreAt(hostname, record.dir); err == nil {
+				return nil
+			}
+			err = fmt.Errorf("Restore at %v failed: %v", hostname, err)
+		}
+	}
+
+	for _, buddy := range record.replicas {
+		if !c.nymphSet.IsAlive(Location{buddy}) {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"rank":       rank,
+			"nymph":      buddy,
+			"generation": record.image.Generation,
+		}).Info("Restarting rank from a replica")
+
+		if err = restoreReplicaAt(buddy, record.image); err == nil {
+			return nil
+		}
+		err = fmt.Errorf("Restore of the replica at %v failed: %v", buddy, err)
+	}
+
+	if err == nil {
+		err = fmt.Errorf("No replica survives")
+	}
+
+	return err
+}
+
+func restoreAt(hostname, dir string) error {
+	client, err := nymph.NewClientOnce(hostname)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, err = client.Restore(dir)
+	return err
+}
+
+// Restore the rank from its checkpoint. A failed attempt is repeated after a delay growing
+// with every attempt. The restored rank is registered by its new nymph. Returns false, if
+// the rank could not be restarted. Runs outside of the control loop.
+func (c *Control) restartRank(rank container.Rank, record checkpointRecord, attempts int) bool {
+	delay := getTimeout(config.CoordinatorRestartDelay, defaultRestartDelay)
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var hostname string
+		if c.RequestReply(&LocateContainerArgs{Rank: rank}, &hostname) == nil {
+			log.WithFields(log.Fields{
+				"rank":  rank,
+				"nymph": hostname,
+			}).Info("Rank runs again, no restart needed")
+			return true
+		}
+
+		if err = c.restoreCheckpoint(rank, record); err == nil {
+			log.WithField("rank", rank).Info("Rank has been restarted")
+			return true
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"rank":    rank,
+			"attempt": attempt,
+		}).Warn("Restart attempt failed")
+
+		if attempt < attempts {
+			time.Sleep(time.Duration(attempt) * delay)
+		}
+	}
+
+	log.WithError(err).WithField("rank", rank).Error("Giving up restarting the rank, it is lost")
+	return false
+}
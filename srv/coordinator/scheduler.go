@@ -1,86 +1,182 @@
 package coordinator
 
 import (
-	"log"
-	"math/rand"
+	"fmt"
+	"sort"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/config"
 	"github.com/planetA/konk/pkg/container"
 	. "github.com/planetA/konk/pkg/coordinator"
 )
 
-type Scheduler struct {
-	control *Control
+const (
+	defaultSchedulerPolicy   = "none"
+	defaultSchedulerInterval = 10 * time.Second
+)
+
+// State of the cluster, as a scheduling policy sees it
+type Snapshot struct {
+	// Current location of every rank
+	Locations map[container.Rank]Location
+	// Nymphs that can accept containers, sorted by hostname
+	Nymphs []Location
+	// Resources last reported by the nymphs
+	Metrics map[Location]NymphMetrics
 }
 
-func NewScheduler(control *Control) *Scheduler {
-	return &Scheduler{
-		control: control,
+// Ranks sorted in ascending order
+func (s *Snapshot) Ranks() []container.Rank {
+	ranks := make([]container.Rank, 0, len(s.Locations))
+	for rank := range s.Locations {
+		ranks = append(ranks, rank)
 	}
+	sort.Slice(ranks, func(i, j int) bool { return ranks[i] < ranks[j] })
+
+	return ranks
 }
 
-func getRanks(locDB LocationDB) []container.Rank {
-	ranks := make(map[container.Rank]bool)
-	for rank := range locDB.db {
-		ranks[rank] = true
+// Ranks grouped by nymph. Every nymph from the snapshot is present, even without ranks.
+func (s *Snapshot) RanksPerNymph() map[Location][]container.Rank {
+	perNymph := make(map[Location][]container.Rank, len(s.Nymphs))
+	for _, nymph := range s.Nymphs {
+		perNymph[nymph] = make([]container.Rank, 0)
 	}
 
-	ranksV := make([]container.Rank, len(ranks))
-	i := 0
-	for rank := range ranks {
-		ranksV[i] = rank
-		i = i + 1
+	for _, rank := range s.Ranks() {
+		location := s.Locations[rank]
+		if _, ok := perNymph[location]; ok {
+			perNymph[location] = append(perNymph[location], rank)
+		}
 	}
 
-	return ranksV
+	return perNymph
 }
 
-func (s *Scheduler) Start() {
-	ticker := time.NewTicker(10 * time.Second)
-	lastLen := 0
-	for t := range ticker.C {
-		log.Printf("About to reschedule @%v\n", t)
-		ranks := getRanks(s.control.locationDB.Dump())
-		locs := s.control.nymphSet.GetNymphs()
-		log.Printf("RANK: %v LOCATION: %v\n", ranks, locs)
-
-		curLen := len(ranks)
-		if !(curLen > 0 && lastLen == curLen) {
-			lastLen = curLen
-			continue
-		}
-		lastLen = curLen
+// A request of a policy to move a rank
+type Decision struct {
+	Rank          container.Rank
+	Dest          Location
+	MigrationType container.MigrationType
+}
 
-		if len(locs) < 2 {
-			continue
-		}
+// The scheduler decides on the placement of the ranks. The coordinator periodically passes
+// the scheduler a snapshot of the cluster and executes the decisions it returns.
+type Scheduler interface {
+	Schedule(snapshot *Snapshot) []Decision
+}
 
-		// Attempt migration
+type SchedulerFactory func() Scheduler
 
-		// Pick a random container
-		targetCont := ranks[rand.Intn(len(ranks))]
+var schedulers = make(map[string]SchedulerFactory)
 
-		// Figure where it runs
-		srcLoc, ok := s.control.locationDB.Get(targetCont)
-		if !ok {
-			log.Panicf("We've just seen it (%v)! ", targetCont)
-		}
+// Make a scheduling policy available under the given name
+func RegisterScheduler(name string, factory SchedulerFactory) {
+	if _, ok := schedulers[name]; ok {
+		log.WithField("name", name).Panic("Scheduler is registered twice")
+	}
 
-		// Remove the source location
-		for i := 0; i < len(locs); i++ {
-			if locs[i] == srcLoc {
-				locs = append(locs[:i], locs[i+1:]...)
-				break
+	schedulers[name] = factory
+}
+
+func NewScheduler(name string) (Scheduler, error) {
+	factory, ok := schedulers[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown scheduling policy: %v", name)
+	}
+
+	return factory(), nil
+}
+
+// Drives a scheduling policy
+type SchedulerLoop struct {
+	control   *Control
+	scheduler Scheduler
+	interval  time.Duration
+}
+
+func NewSchedulerLoop(control *Control) (*SchedulerLoop, error) {
+	policy, ok := config.GetStringOk(config.CoordinatorSchedulerPolicy)
+	if !ok {
+		policy = defaultSchedulerPolicy
+	}
+
+	scheduler, err := NewScheduler(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := getTimeout(config.CoordinatorSchedulerInterval, defaultSchedulerInterval)
+
+	log.WithFields(log.Fields{
+		"policy":   policy,
+		"interval": interval,
+	}).Info("Created scheduler")
+
+	return &SchedulerLoop{
+		control:   control,
+		scheduler: scheduler,
+		interval:  interval,
+	}, nil
+}
+
+func (s *SchedulerLoop) snapshot() *Snapshot {
+	nymphs := s.control.nymphSet.GetSchedulableNymphs()
+	sort.Slice(nymphs, func(i, j int) bool { return nymphs[i].Hostname < nymphs[j].Hostname })
+
+	return &Snapshot{
+		Locations: s.control.locationDB.Copy(),
+		Nymphs:    nymphs,
+		Metrics:   s.control.nymphSet.GetMetrics(),
+	}
+}
+
+func (s *SchedulerLoop) Start() {
+	ticker := time.NewTicker(s.interval)
+	for t := range ticker.C {
+		snapshot := s.snapshot()
+		log.WithFields(log.Fields{
+			"time":      t,
+			"locations": snapshot.Locations,
+			"nymphs":    snapshot.Nymphs,
+		}).Trace("About to reschedule")
+
+		for _, decision := range s.scheduler.Schedule(snapshot) {
+			if cur, ok := s.control.locationDB.Get(decision.Rank); !ok || cur == decision.Dest {
+				continue
+			}
+
+			// The snapshot does not know about migrations in flight
+			if s.control.migrations.Busy(decision.Rank) {
+				continue
 			}
-		}
 
-		// Pick a target location
-		targetLoc := locs[rand.Intn(len(locs))]
+			log.WithFields(log.Fields{
+				"rank": decision.Rank,
+				"dest": decision.Dest.Hostname,
+				"type": decision.MigrationType,
+			}).Info("Scheduler requests migration")
 
-		log.Printf("Migrating %v from %v to %v\n", targetCont, srcLoc, targetLoc)
-		migrateReq := &MigrateArgs{targetCont, targetLoc.Hostname, container.Migrate}
-		if err := s.control.Request(migrateReq); err != nil {
-			log.Println("Failed to migrate: %v", err)
+			migrateReq := &MigrateArgs{
+				Rank:          decision.Rank,
+				DestHost:      decision.Dest.Hostname,
+				MigrationType: decision.MigrationType,
+			}
+			// Decisions are independent, so they migrate concurrently
+			migrateReply := &MigrateReply{}
+			job := s.control.migrations.Submit(migrateReq, migrateReply)
+			go func(rank container.Rank) {
+				if err := <-job.done; err != nil {
+					log.WithError(err).WithField("rank", rank).Error("Failed to migrate")
+				} else if migrateReply.RolledBack {
+					log.WithFields(log.Fields{
+						"rank":  rank,
+						"error": migrateReply.Error,
+					}).Warn("Migration has been rolled back")
+				}
+			}(decision.Rank)
 		}
 	}
 }
@@ -1,6 +1,9 @@
 package coordinator
 
 import (
+	"fmt"
+
+	"github.com/planetA/konk/pkg/container"
 	. "github.com/planetA/konk/pkg/coordinator"
 )
 
@@ -22,6 +25,15 @@ func (c *Coordinator) AllocateHost(args *AllocateHostArgs, hostname *string) err
 	return nil
 }
 
+// Return the hostname of the nymph currently running the container
+func (c *Coordinator) LocateContainer(args *LocateContainerArgs, hostname *string) error {
+	if err := c.control.RequestReply(args, hostname); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (c *Coordinator) RegisterContainer(args *RegisterContainerArgs, reply *bool) error {
 	if err := c.control.Request(args); err != nil {
 		*reply = false
@@ -44,8 +56,34 @@ func (c *Coordinator) UnregisterContainer(args *UnregisterContainerArgs, reply *
 }
 
 // Coordinator can receive a migration request from an external entity.
-func (c *Coordinator) Migrate(args *MigrateArgs, reply *bool) error {
-	if err := c.control.Request(args); err != nil {
+func (c *Coordinator) Migrate(args *MigrateArgs, reply *MigrateReply) error {
+	return c.control.Migrate(args, reply)
+}
+
+// Migrate many ranks at once, or evacuate a nymph
+func (c *Coordinator) MigrateBatch(args *MigrateBatchArgs, reply *MigrateBatchReply) error {
+	return c.control.MigrateBatch(args, reply)
+}
+
+func (c *Coordinator) MigrationStatus(args *MigrationStatusArgs, reply *MigrationStatus) error {
+	status, ok := c.control.migrations.Status(args.ID)
+	if !ok {
+		return fmt.Errorf("Migration %v is not known", args.ID)
+	}
+
+	*reply = status
+	return nil
+}
+
+func (c *Coordinator) ListMigrations(args *ListMigrationsArgs, reply *[]MigrationStatus) error {
+	*reply = c.control.migrations.List(args.All)
+	return nil
+}
+
+// Nymphs report the progress of migrations. Like heartbeats, the reports do not go through
+// the request queue.
+func (c *Coordinator) MigrationProgress(args *MigrationProgressArgs, reply *bool) error {
+	if err := c.control.migrations.Progress(args); err != nil {
 		*reply = false
 		return err
 	}
@@ -54,12 +92,30 @@ func (c *Coordinator) Migrate(args *MigrateArgs, reply *bool) error {
 	return nil
 }
 
-func (c *Coordinator) Signal(args *SignalArgs, anyErr *error) error {
+// Nymphs report the latest good checkpoint of their ranks
+func (c *Coordinator) ReportCheckpoint(args *ReportCheckpointArgs, reply *bool) error {
 	if err := c.control.Request(args); err != nil {
-		*anyErr = err
+		*reply = false
+		return err
+	}
+
+	*reply = true
+	return nil
+}
+
+// A nymph, that registers again, destroys the containers, that have been restarted elsewhere
+func (c *Coordinator) FencedContainers(args *FencedContainersArgs, reply *[]container.Rank) error {
+	return c.control.RequestReply(args, reply)
+}
+
+// Deliver a signal to the ranks listed in the request, or to all known ranks
+func (c *Coordinator) Signal(args *SignalArgs, reply *bool) error {
+	if err := c.control.Signal(args); err != nil {
+		*reply = false
 		return err
 	}
 
+	*reply = true
 	return nil
 }
 
@@ -80,3 +136,14 @@ func (c *Coordinator) UnregisterNymph(args *UnregisterNymphArgs, reply *bool) er
 	*reply = true
 	return nil
 }
+
+// Nymphs periodically report that they are alive
+func (c *Coordinator) Heartbeat(args *HeartbeatArgs, reply *bool) error {
+	if err := c.control.Heartbeat(args); err != nil {
+		*reply = false
+		return err
+	}
+
+	*reply = true
+	return nil
+}
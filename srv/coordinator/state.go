@@ -0,0 +1,207 @@
+package coordinator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+)
+
+type StateEventType string
+
+const (
+	EventRegisterContainer   StateEventType = "register-container"
+	EventUnregisterContainer StateEventType = "unregister-container"
+	EventMigrateContainer    StateEventType = "migrate-container"
+	EventRegisterNymph       StateEventType = "register-nymph"
+	EventUnregisterNymph     StateEventType = "unregister-nymph"
+	EventCheckpoint          StateEventType = "checkpoint"
+	EventDropCheckpoint      StateEventType = "drop-checkpoint"
+	EventFence               StateEventType = "fence"
+	EventUnfence             StateEventType = "unfence"
+)
+
+// A change of the coordinator state
+type StateEvent struct {
+	Type     StateEventType
+	Rank     container.Rank `json:",omitempty"`
+	Hostname string
+	NymphId  uint `json:",omitempty"`
+
+	Image    *container.ImageInfoArgs `json:",omitempty"`
+	Dir      string                   `json:",omitempty"`
+	Replicas []string                 `json:",omitempty"`
+}
+
+// Persistent storage for the coordinator state. The coordinator records every change of
+// the container locations, of the set of nymphs and of the latest checkpoints and replays
+// the changes at start.
+type StateStore interface {
+	// Persist an event
+	Append(event StateEvent) error
+
+	// Call apply for every persisted event in the order they were recorded
+	Replay(apply func(event StateEvent) error) error
+
+	// Replace all recorded events by the given ones
+	Compact(events []StateEvent) error
+
+	Close() error
+}
+
+const (
+	stateStoreNone = "none"
+	stateStoreLog  = "log"
+)
+
+func NewStateStore(storeType, storePath string) (StateStore, error) {
+	switch storeType {
+	case stateStoreNone, "":
+		return &noneStateStore{}, nil
+	case stateStoreLog:
+		return newLogStateStore(storePath)
+	default:
+		return nil, fmt.Errorf("Unknown state store type: %v", storeType)
+	}
+}
+
+// The store that does not remember anything
+type noneStateStore struct {
+}
+
+func (s *noneStateStore) Append(event StateEvent) error {
+	return nil
+}
+
+func (s *noneStateStore) Replay(apply func(event StateEvent) error) error {
+	return nil
+}
+
+func (s *noneStateStore) Compact(events []StateEvent) error {
+	return nil
+}
+
+func (s *noneStateStore) Close() error {
+	return nil
+}
+
+// The store keeps events in an append-only file, one JSON object per line
+type logStateStore struct {
+	path string
+	file *os.File
+}
+
+func newLogStateStore(storePath string) (*logStateStore, error) {
+	if storePath == "" {
+		return nil, fmt.Errorf("Path to the state log is not set")
+	}
+
+	dir, _ := path.Split(storePath)
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			return nil, fmt.Errorf("Failed to create directory %v: %v", dir, err)
+		}
+	}
+
+	file, err := os.OpenFile(storePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open state log %v: %v", storePath, err)
+	}
+
+	return &logStateStore{
+		path: storePath,
+		file: file,
+	}, nil
+}
+
+func (s *logStateStore) Append(event StateEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("Failed to write state log: %v", err)
+	}
+
+	return s.file.Sync()
+}
+
+func (s *logStateStore) Replay(apply func(event StateEvent) error) error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("Failed to open state log %v: %v", s.path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		var event StateEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// The last line may be incomplete, if the coordinator crashed while writing
+			log.WithError(err).WithFields(log.Fields{
+				"path": s.path,
+				"line": line,
+			}).Warn("Skipping broken state log entry")
+			continue
+		}
+
+		if err := apply(event); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (s *logStateStore) Compact(events []StateEvent) error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return fmt.Errorf("Failed to create %v: %v", tmpPath, err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("Failed to replace state log: %v", err)
+	}
+
+	s.file.Close()
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		return fmt.Errorf("Failed to reopen state log %v: %v", s.path, err)
+	}
+
+	return nil
+}
+
+func (s *logStateStore) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,166 @@
+package coordinator
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/planetA/konk/pkg/container"
+)
+
+func openTestLog(t *testing.T) (*logStateStore, func()) {
+	dir, err := ioutil.TempDir("", "konk-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newLogStateStore(path.Join(dir, "state", "log"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func replayAll(t *testing.T, store StateStore) []StateEvent {
+	events := make([]StateEvent, 0)
+	err := store.Replay(func(event StateEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	return events
+}
+
+func TestLogStateStore(t *testing.T) {
+	store, cleanup := openTestLog(t)
+	defer cleanup()
+
+	appended := []StateEvent{
+		{Type: EventRegisterNymph, Hostname: "a", NymphId: 1},
+		{Type: EventRegisterContainer, Rank: 0, Hostname: "a"},
+		{Type: EventCheckpoint, Rank: 0, Hostname: "a", Replicas: []string{"b"},
+			Image: &container.ImageInfoArgs{ID: "cont", Generation: 1}},
+	}
+	for _, event := range appended {
+		if err := store.Append(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The coordinator crashed in the middle of a write
+	if _, err := store.file.Write([]byte(`{"Type": "regis`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if events := replayAll(t, store); !reflect.DeepEqual(events, appended) {
+		t.Errorf("Expected %v, got %v", appended, events)
+	}
+
+	compacted := []StateEvent{{Type: EventRegisterContainer, Rank: 0, Hostname: "b"}}
+	if err := store.Compact(compacted); err != nil {
+		t.Fatal(err)
+	}
+
+	next := StateEvent{Type: EventRegisterContainer, Rank: 1, Hostname: "b"}
+	if err := store.Append(next); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(compacted, next)
+	if events := replayAll(t, store); !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %v after compaction, got %v", expected, events)
+	}
+}
+
+// A restarted coordinator restores the state from the log and compacts the log to a
+// snapshot, that leads to the same state
+func TestRestore(t *testing.T) {
+	store, cleanup := openTestLog(t)
+	defer cleanup()
+
+	for _, event := range []StateEvent{
+		{Type: EventRegisterNymph, Hostname: "a", NymphId: 0},
+		{Type: EventRegisterNymph, Hostname: "b", NymphId: 1},
+		{Type: EventRegisterNymph, Hostname: "c", NymphId: 2},
+		{Type: EventRegisterContainer, Rank: 0, Hostname: "a"},
+		{Type: EventRegisterContainer, Rank: 1, Hostname: "a"},
+		{Type: EventMigrateContainer, Rank: 1, Hostname: "b"},
+		{Type: EventRegisterContainer, Rank: 2, Hostname: "a"},
+		{Type: EventUnregisterContainer, Rank: 2, Hostname: "a"},
+		// Stale unregister from the old place of a migrated rank
+		{Type: EventUnregisterContainer, Rank: 1, Hostname: "a"},
+		{Type: EventUnregisterNymph, Hostname: "c"},
+		{Type: EventCheckpoint, Rank: 0, Hostname: "a", Dir: "/storage",
+			Image: &container.ImageInfoArgs{ID: "cont", Generation: 4}},
+		{Type: EventCheckpoint, Rank: 2, Hostname: "a",
+			Image: &container.ImageInfoArgs{ID: "other", Generation: 1}},
+		{Type: EventDropCheckpoint, Rank: 2},
+		{Type: EventFence, Rank: 1, Hostname: "c"},
+	} {
+		if err := store.Append(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewControl(store)
+	if err := c.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	locations := map[container.Rank]Location{0: {"a"}, 1: {"b"}}
+	if !reflect.DeepEqual(c.locationDB.Copy(), locations) {
+		t.Errorf("Expected locations %v, got %v", locations, c.locationDB.Copy())
+	}
+
+	nymphs := map[Location]uint{{"a"}: 0, {"b"}: 1}
+	if !reflect.DeepEqual(c.nymphSet.GetNymphIds(), nymphs) {
+		t.Errorf("Expected nymphs %v, got %v", nymphs, c.nymphSet.GetNymphIds())
+	}
+
+	if record, ok := c.checkpoints.Get(0); !ok || record.dir != "/storage" || record.image.Generation != 4 {
+		t.Errorf("Expected generation 4 of rank 0 in the storage, got %+v", record)
+	}
+
+	if _, ok := c.checkpoints.Get(2); ok {
+		t.Errorf("Checkpoint of rank 2 has been dropped")
+	}
+
+	if !c.fences.Has(Location{"c"}, 1) {
+		t.Errorf("Rank 1 should stay fenced at c")
+	}
+
+	restored := NewControl(&noneStateStore{})
+	for _, event := range replayAll(t, store) {
+		if err := restored.applyEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !reflect.DeepEqual(restored.locationDB.Copy(), c.locationDB.Copy()) ||
+		!reflect.DeepEqual(restored.nymphSet.GetNymphIds(), c.nymphSet.GetNymphIds()) ||
+		!reflect.DeepEqual(restored.checkpoints.records, c.checkpoints.records) ||
+		!reflect.DeepEqual(restored.fences.fences, c.fences.fences) {
+		t.Errorf("Compacted log does not recreate the state")
+	}
+}
+
+func TestRestoreRejectsBadEvents(t *testing.T) {
+	for _, event := range []StateEvent{
+		{Type: EventCheckpoint, Rank: 0, Hostname: "a"},
+		{Type: "unknown", Hostname: "a"},
+	} {
+		if err := NewControl(&noneStateStore{}).applyEvent(event); err == nil {
+			t.Errorf("Event %v should be rejected", event)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package nymph
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+	"github.com/planetA/konk/pkg/coordinator"
+)
+
+// Call the coordinator. If the connection is gone, e.g., because the coordinator has
+// restarted, the coordinator is dialed once again and the call is repeated.
+func (n *Nymph) callCoordinator(call func(client *coordinator.Client) error) error {
+	n.coordinatorMutex.Lock()
+	client := n.coordinatorClient
+	n.coordinatorMutex.Unlock()
+
+	err := call(client)
+	if !coordinator.IsConnectionError(err) {
+		return err
+	}
+
+	client, dialErr := n.redialCoordinator(client)
+	if dialErr != nil {
+		return fmt.Errorf("%v; reconnect failed: %v", err, dialErr)
+	}
+
+	return call(client)
+}
+
+// Replace the failed connection to the coordinator. If another caller has replaced it
+// already, the new connection is used.
+func (n *Nymph) redialCoordinator(failed *coordinator.Client) (*coordinator.Client, error) {
+	n.coordinatorMutex.Lock()
+	defer n.coordinatorMutex.Unlock()
+
+	if n.coordinatorClient != failed {
+		return n.coordinatorClient, nil
+	}
+
+	client, err := coordinator.NewClientOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	failed.Close()
+	n.coordinatorClient = client
+
+	log.Info("Reconnected to the coordinator")
+	return client, nil
+}
+
+func (n *Nymph) registerContainer(rank container.Rank) error {
+	return n.callCoordinator(func(client *coordinator.Client) error {
+		return client.RegisterContainer(rank, n.hostname)
+	})
+}
+
+func (n *Nymph) unregisterContainer(rank container.Rank) error {
+	return n.callCoordinator(func(client *coordinator.Client) error {
+		return client.UnregisterContainer(rank)
+	})
+}
+
+func (n *Nymph) reportCheckpoint(args *coordinator.ReportCheckpointArgs) error {
+	return n.callCoordinator(func(client *coordinator.Client) error {
+		return client.ReportCheckpoint(args)
+	})
+}
+
+func (n *Nymph) reportProgress(args *coordinator.MigrationProgressArgs) error {
+	return n.callCoordinator(func(client *coordinator.Client) error {
+		return client.MigrationProgress(args)
+	})
+}
+
+// ID assigned to the nymph by the coordinator at the last registration
+func (n *Nymph) nymphId() uint {
+	n.coordinatorMutex.Lock()
+	defer n.coordinatorMutex.Unlock()
+
+	return n.Id
+}
@@ -0,0 +1,154 @@
+package nymph
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/nymph"
+)
+
+// Longest compressed chunk accepted over a data channel
+const maxCompressedChunk = 2 * int64(ChunkSize)
+
+// Report the port, that accepts data channels
+func (r *Recipient) DataPort(args container.DataPortArgs, port *int) error {
+	*port = r.dataListener.Addr().(*net.TCPAddr).Port
+	return nil
+}
+
+// Accept data channels, until the listener is closed
+func (r *Recipient) serveData() {
+	for {
+		conn, err := r.dataListener.Accept()
+		if err != nil {
+			log.WithError(err).Debug("Stopped accepting data channels")
+			return
+		}
+
+		go r.handleData(conn)
+	}
+}
+
+// Receive frames of a data channel. After a frame fails, the following frames are skipped
+// until the next sync, which reports the failure to the donor.
+func (r *Recipient) handleData(conn net.Conn) {
+	defer conn.Close()
+
+	id, err := ReadDataSession(conn)
+	if err != nil {
+		log.WithError(err).Warn("Failed to read session of data channel")
+		return
+	}
+
+	if _, err := r.getSession(id); err != nil {
+		WriteDataStatus(conn, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"session": id,
+		"donor":   conn.RemoteAddr(),
+	}).Debug("Accepted data channel")
+
+	var failed error
+	for {
+		handle, offset, length, err := ReadDataHeader(conn)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.WithError(err).WithField("session", id).Warn("Data channel has been interrupted")
+			return
+		}
+
+		if handle == DataSync {
+			// Keeps the session alive during long transfers
+			if _, err := r.getSession(id); err != nil && failed == nil {
+				failed = err
+			}
+
+			if err := WriteDataStatus(conn, failed); err != nil {
+				log.WithError(err).WithField("session", id).Warn("Failed to report status")
+				return
+			}
+			failed = nil
+			continue
+		}
+
+		if length < 0 {
+			log.WithField("length", length).Warn("Unexpected frame length, closing data channel")
+			return
+		}
+
+		consumed, err := r.receiveFrame(id, conn, handle, offset, length)
+		if err != nil && failed == nil {
+			log.WithError(err).WithField("handle", handle).Error("Failed to receive data")
+			failed = err
+		}
+
+		// Keep the stream in sync by skipping the rest of a failed frame
+		if consumed < length {
+			if _, err := io.CopyN(ioutil.Discard, conn, length-consumed); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Store the data of a frame into the file. Returns how much of the frame has been read from
+// the connection.
+func (r *Recipient) receiveFrame(id string, conn net.Conn, handle int, offset int64, length int64) (int64, error) {
+	s, err := r.getSession(id)
+	if err != nil {
+		return 0, err
+	}
+
+	incoming, err := s.file(handle)
+	if err != nil {
+		return 0, err
+	}
+
+	if incoming.compression != CompressionNone {
+		if length > maxCompressedChunk {
+			return 0, fmt.Errorf("Chunk of %s is too large: %v", incoming.filename, length)
+		}
+
+		chunk := make([]byte, length)
+		if _, err := io.ReadFull(conn, chunk); err != nil {
+			return 0, err
+		}
+
+		return length, r.storeChunk(s, handle, incoming, offset, chunk)
+	}
+
+	if offset < 0 || offset+length > incoming.size {
+		return 0, fmt.Errorf("Unexpected chunk at offset %v of size %v in %s", offset, length, incoming.filename)
+	}
+
+	written, err := incoming.receive(conn, offset, length)
+	if err != nil {
+		return written, fmt.Errorf("Failed to write the file: %v", err)
+	}
+
+	if written != length {
+		return written, fmt.Errorf("Data channel has been closed in the middle of a chunk")
+	}
+
+	return written, r.chunkWritten(s, handle, incoming, offset, length)
+}
+
+// Copy a chunk from the connection into the file. The kernel moves the data without
+// passing it through user space.
+func (incoming *incomingFile) receive(conn net.Conn, offset int64, length int64) (int64, error) {
+	if _, err := incoming.file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	// File.ReadFrom uses splice for a limited socket reader
+	return incoming.file.ReadFrom(io.LimitReader(conn, length))
+}
@@ -0,0 +1,32 @@
+package nymph
+
+import (
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+)
+
+// Destroy the copies of the ranks, that the coordinator has restarted at other nymphs, while
+// it considered this nymph dead. Waiters are told, that the ranks have moved, and ask the
+// coordinator for the new location. The coordinator lifts the fence, once the copy is
+// unregistered.
+func (n *Nymph) destroyFenced(ranks []container.Rank) {
+	for _, rank := range ranks {
+		if cont, err := n.Containers.Get(rank); err == nil {
+			log.WithField("rank", rank).Warn("Container has been restarted elsewhere, destroying the local copy")
+
+			n.tombstones.AddMigrated(rank)
+			cont.SetMigrating(true)
+			if err := cont.Signal(syscall.SIGKILL, true); err != nil {
+				log.WithError(err).WithField("rank", rank).Warn("Failed to kill the fenced container")
+			}
+			n.Containers.Delete(cont)
+		}
+
+		if err := n.unregisterContainer(rank); err != nil {
+			log.WithError(err).WithField("rank", rank).Error("Failed to unregister the fenced container")
+		}
+	}
+}
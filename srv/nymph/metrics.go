@@ -0,0 +1,54 @@
+package nymph
+
+import (
+	"runtime"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/mem"
+
+	"github.com/planetA/konk/pkg/coordinator"
+)
+
+// Collect resource usage of the node and of the containers running at it. Failures are
+// not fatal, the coordinator gets whatever could be collected.
+func (n *Nymph) collectMetrics() coordinator.NymphMetrics {
+	metrics := coordinator.NymphMetrics{
+		CpuCount:   runtime.NumCPU(),
+		Containers: make([]coordinator.ContainerMetrics, 0),
+	}
+
+	if avg, err := load.Avg(); err != nil {
+		log.WithError(err).Debug("Failed to get load average")
+	} else {
+		metrics.Load1 = avg.Load1
+	}
+
+	if vmem, err := mem.VirtualMemory(); err != nil {
+		log.WithError(err).Debug("Failed to get memory statistics")
+	} else {
+		metrics.MemoryFree = vmem.Available
+		metrics.MemoryTotal = vmem.Total
+	}
+
+	for _, rank := range n.Containers.Ranks() {
+		cont, err := n.Containers.Get(rank)
+		if err != nil {
+			continue
+		}
+
+		stats, err := cont.Stats()
+		if err != nil || stats.CgroupStats == nil {
+			log.WithError(err).WithField("rank", rank).Trace("Failed to get container statistics")
+			continue
+		}
+
+		metrics.Containers = append(metrics.Containers, coordinator.ContainerMetrics{
+			Rank:        rank,
+			MemoryUsage: stats.CgroupStats.MemoryStats.Usage.Usage,
+		})
+	}
+
+	return metrics
+}
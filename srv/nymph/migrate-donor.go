@@ -1,53 +1,166 @@
 package nymph
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/rpc"
 	"os"
 	"path"
+	"sync"
+	"time"
 
+	"github.com/opencontainers/runc/libcontainer"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/planetA/konk/config"
 	"github.com/planetA/konk/pkg/container"
+	"github.com/planetA/konk/pkg/coordinator"
 	"github.com/planetA/konk/pkg/nymph"
 )
 
 const (
 	ChunkSize int = 1 << 21
+
+	// Number of files sent at the same time, if not configured
+	defaultParallelFiles = 4
+	// Number of chunks of a file sent without waiting for the recipient, if not configured
+	defaultWindow = 4
+	// Number of times the donor reconnects during a checkpoint transfer, if not configured
+	defaultResumeAttempts = 3
+	resumeDelay           = time.Second
 )
 
 type MigrationDonor struct {
-	Checkpoint      container.Checkpoint
 	recipientClient *nymph.MigrationClient
 	recipient       string
 	openFiles       []string
 	rootDir         string
+	// Transfer session at the recipient, that survives reconnects
+	session    string
+	relaunched bool
+	// The relaunch request has been sent, but the reply may have been lost
+	relaunchRequested bool
+	// The recipient keeps the checkpoint as a replica
+	replicated bool
+	// Generations, that the recipient has received in the session
+	sent map[int]bool
+	// Compression of file data agreed with the recipient
+	compression    string
+	parallelFiles  int
+	window         int
+	resumeAttempts int
+
+	// Limits of the transfer rate, that the data has to pass
+	limiters []*rateLimiter
+
+	progress *progressReporter
+
+	// What the recipient already has of the current checkpoint, if the transfer is resumed
+	resume map[string]container.FileState
+
+	// Protects the transfer state below, because files are sent concurrently
+	mutex sync.Mutex
+	// Hashes of the files sent for the current checkpoint
+	manifest container.Manifest
+	// Bytes of file data before and after compression
+	rawBytes  int64
+	sentBytes int64
 }
 
-func NewMigrationDonor(rootDir string, checkpoint container.Checkpoint, recipient string) (*MigrationDonor, error) {
-	client, err := nymph.NewMigrationClient(recipient)
+func getPositiveInt(key config.ViperKey, defaultValue int) int {
+	if value, ok := config.GetIntOk(key); ok && value > 0 {
+		return value
+	}
+
+	return defaultValue
+}
+
+// Compressions to offer to the recipient, the configured one first
+func offeredCompressions() []string {
+	compression, ok := config.GetStringOk(config.NymphMigrationCompression)
+	if !ok || compression == nymph.CompressionNone {
+		return []string{nymph.CompressionNone}
+	}
+
+	if !nymph.SupportsCompression(compression) {
+		log.WithField("compression", compression).Warn("Unknown compression, sending uncompressed")
+		return []string{nymph.CompressionNone}
+	}
+
+	return []string{compression, nymph.CompressionNone}
+}
+
+func newSessionId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+func NewMigrationDonor(rootDir string, recipient string, limiters []*rateLimiter, progress *progressReporter) (*MigrationDonor, error) {
+	session, err := newSessionId()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create session ID: %v", err)
+	}
+
+	migration := &MigrationDonor{
+		recipient:      recipient,
+		rootDir:        rootDir,
+		session:        session,
+		limiters:       limiters,
+		progress:       progress,
+		manifest:       make(container.Manifest),
+		sent:           make(map[int]bool),
+		parallelFiles:  getPositiveInt(config.NymphMigrationParallelFiles, defaultParallelFiles),
+		window:         getPositiveInt(config.NymphMigrationWindow, defaultWindow),
+		resumeAttempts: getPositiveInt(config.NymphMigrationResumeAttempts, defaultResumeAttempts),
+	}
+
+	if _, err := migration.connect(); err != nil {
+		return nil, err
+	}
+
+	return migration, nil
+}
+
+// Connect to the recipient and join the transfer session. Returns what the recipient has
+// received in the session so far.
+func (migration *MigrationDonor) connect() (*container.SessionState, error) {
+	client, err := nymph.NewMigrationClient(migration.recipient)
 	if err != nil {
 		log.WithError(err).Error("Client creation failed")
 		return nil, fmt.Errorf("Failed to open a connection to the recipient: %v", err)
 	}
 
-	return &MigrationDonor{
-		Checkpoint:      checkpoint,
-		recipientClient: client,
-		recipient:       recipient,
-		rootDir:         rootDir,
-	}, nil
-}
+	compression, err := client.Negotiate(offeredCompressions())
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Failed to negotiate with the recipient: %v", err)
+	}
 
-func (m *MigrationDonor) sendState() error {
-	err := m.recipientClient.ImageInfo(m.Checkpoint.ImageInfo())
+	state, err := client.OpenSession(migration.session)
 	if err != nil {
-		return err
+		client.Close()
+		return nil, fmt.Errorf("Failed to open a session at the recipient: %v", err)
 	}
 
-	stateFile := m.Checkpoint.StatePath()
+	migration.recipientClient = client
+	migration.compression = compression
+
+	return state, nil
+}
+
+func (m *MigrationDonor) sendState(checkpoint container.Checkpoint) error {
+	stateFile := checkpoint.StatePath()
 
-	if err := m.SendFile(stateFile); err != nil {
+	if err := m.SendFile(context.Background(), stateFile, nil); err != nil {
 		return fmt.Errorf("Failed to transfer the file %s: %v", stateFile, err)
 	}
 
@@ -55,36 +168,98 @@ func (m *MigrationDonor) sendState() error {
 	return nil
 }
 
-func (migration *MigrationDonor) sendImage() error {
-	checkpointDir, err := os.Open(migration.Checkpoint.PathAbs())
+// Send the files of the checkpoint directory, several of them at the same time
+func (migration *MigrationDonor) sendImage(checkpoint container.Checkpoint) error {
+	checkpointDir, err := os.Open(checkpoint.PathAbs())
 	if err != nil {
 		log.WithFields(log.Fields{
-			"dir":   migration.Checkpoint.PathAbs(),
+			"dir":   checkpoint.PathAbs(),
 			"error": err,
 		}).Error("Failed to open checkpoint dir")
 		return fmt.Errorf("Failed to open checkpoint dir: %v", err)
 	}
+	defer checkpointDir.Close()
 
 	files, err := checkpointDir.Readdir(0)
 	if err != nil {
 		return fmt.Errorf("Failed to read the contents of checkpoint directory: %v", err)
 	}
 
+	// The first error stops every worker, so that the session can be discarded right away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var errOnce sync.Once
+	var sendErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			sendErr = err
+			cancel()
+		})
+	}
+
+	filenames := make(chan string)
+
+	var wg sync.WaitGroup
+	for i := 0; i < migration.parallelFiles; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Each worker streams over its own connection
+			channel := migration.openDataChannel()
+			if channel != nil {
+				defer channel.Close()
+			}
+
+			for filename := range filenames {
+				if err := migration.SendFile(ctx, filename, channel); err != nil {
+					fail(fmt.Errorf("Failed to transfer the file %s: %v", filename, err))
+					continue
+				}
+
+				log.WithField("name", filename).Debug("Sent a file")
+			}
+		}()
+	}
+
+queue:
 	for _, file := range files {
-		filename := path.Join(migration.Checkpoint.Path(), file.Name())
-		err := migration.SendFile(filename)
-		if err != nil {
-			return fmt.Errorf("Failed to transfer the file %s: %v", filename, err)
+		select {
+		case filenames <- path.Join(checkpoint.Path(), file.Name()):
+		case <-ctx.Done():
+			// Do not start new files, once the transfer has failed
+			break queue
 		}
+	}
+	close(filenames)
 
-		log.WithField("name", filename).Debug("Sent a file")
+	wg.Wait()
+
+	return sendErr
+}
+
+// Wait, until the rate limits allow to send n bytes
+func (migration *MigrationDonor) throttle(n int64) {
+	for _, limiter := range migration.limiters {
+		limiter.wait(n)
 	}
+}
 
-	return nil
+// Open a data channel to the recipient. Returns nil, if the data has to go through RPC.
+func (migration *MigrationDonor) openDataChannel() *nymph.DataChannel {
+	channel, err := migration.recipientClient.OpenDataChannel()
+	if err != nil {
+		log.WithError(err).Warn("Data channel is not available, sending data with RPC")
+		return nil
+	}
+
+	return channel
 }
 
-// Send file path relative to container directory root.
-func (migration *MigrationDonor) SendFile(filepath string) error {
+// Send file path relative to container directory root. The data goes through the data
+// channel, if there is one, otherwise with RPC. Stops between chunks, once ctx is canceled.
+func (migration *MigrationDonor) SendFile(ctx context.Context, filepath string, channel *nymph.DataChannel) error {
 	fullpath := path.Join(migration.rootDir, filepath)
 
 	fileInfo, err := os.Lstat(fullpath)
@@ -92,17 +267,56 @@ func (migration *MigrationDonor) SendFile(filepath string) error {
 		return fmt.Errorf("Failed to get file state: %v", err)
 	}
 
-	if fileInfo.Mode() & os.ModeSymlink != 0 {
+	// The map is not modified during the transfer
+	state, resumed := migration.resume[filepath]
+
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
 		link, err := os.Readlink(fullpath)
 		if err != nil {
 			return err
 		}
+
+		linkHash := sha256.Sum256([]byte(link))
+		migration.mutex.Lock()
+		migration.manifest[filepath] = hex.EncodeToString(linkHash[:])
+		migration.mutex.Unlock()
+
+		if resumed && state.Complete {
+			return nil
+		}
+
 		return migration.recipientClient.LinkInfo(filepath, fileInfo, link)
 	}
 
-	err = migration.recipientClient.FileInfo(filepath, fileInfo)
-	if err != nil {
-		return fmt.Errorf("Failed to send file info %s: %v", filepath, err)
+	if resumed && state.Complete {
+		// The manifest still needs the hash of the file
+		hash, err := hashFile(fullpath)
+		if err != nil {
+			return fmt.Errorf("Failed to hash file: %v", err)
+		}
+
+		migration.mutex.Lock()
+		migration.manifest[filepath] = hash
+		migration.mutex.Unlock()
+
+		migration.progress.Sent(fileInfo.Size())
+		return nil
+	}
+
+	// Chunks, that the recipient has already written
+	received := make(map[int64]bool)
+
+	var handle int
+	if resumed {
+		handle = state.Handle
+		for _, offset := range state.Chunks {
+			received[offset] = true
+		}
+	} else {
+		handle, err = migration.recipientClient.FileInfo(filepath, fileInfo, migration.compression)
+		if err != nil {
+			return fmt.Errorf("Failed to send file info %s: %v", filepath, err)
+		}
 	}
 
 	file, err := os.Open(fullpath)
@@ -111,49 +325,395 @@ func (migration *MigrationDonor) SendFile(filepath string) error {
 	}
 	defer file.Close()
 
+	var hash string
+	var raw, sent int64
+	if channel != nil {
+		raw, sent, err = migration.streamChunks(ctx, channel, handle, file, fileInfo.Size(), received)
+		if err == nil {
+			// Streamed data never passes through the donor, so the file is read once more
+			hash, err = hashFile(fullpath)
+		}
+	} else {
+		hash, raw, sent, err = migration.sendChunks(ctx, handle, file, received)
+	}
+	if err != nil {
+		return err
+	}
+
+	migration.mutex.Lock()
+	migration.manifest[filepath] = hash
+	migration.rawBytes += raw
+	migration.sentBytes += sent
+	migration.mutex.Unlock()
+
+	return nil
+}
+
+// Send the chunks of a file over the data channel and wait until the recipient has written
+// them. Without compression the chunks go from the file to the socket directly.
+func (migration *MigrationDonor) streamChunks(ctx context.Context, channel *nymph.DataChannel, handle int, file *os.File, size int64, received map[int64]bool) (int64, int64, error) {
 	buf := make([]byte, ChunkSize)
 
+	var raw, sent int64
+	for offset := int64(0); offset < size; offset += int64(ChunkSize) {
+		if err := ctx.Err(); err != nil {
+			return 0, 0, err
+		}
+
+		length := size - offset
+		if length > int64(ChunkSize) {
+			length = int64(ChunkSize)
+		}
+
+		if received[offset] {
+			migration.progress.Sent(length)
+			continue
+		}
+
+		if migration.compression == nymph.CompressionNone {
+			migration.throttle(length)
+			if err := channel.SendFileRange(handle, file, offset, length); err != nil {
+				return 0, 0, err
+			}
+			migration.progress.Sent(length)
+
+			raw += length
+			sent += length
+			continue
+		}
+
+		n, err := file.ReadAt(buf[:length], offset)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Error while reading file: %v", err)
+		}
+
+		data, err := nymph.Compress(migration.compression, buf[:n])
+		if err != nil {
+			return 0, 0, fmt.Errorf("Failed to compress data: %v", err)
+		}
+
+		migration.throttle(int64(len(data)))
+		if err := channel.SendChunk(handle, offset, data); err != nil {
+			return 0, 0, err
+		}
+		migration.progress.Sent(int64(n))
+
+		raw += int64(n)
+		sent += int64(len(data))
+	}
+
+	if err := channel.Sync(); err != nil {
+		return 0, 0, fmt.Errorf("Error while sending data: %v", err)
+	}
+
+	return raw, sent, nil
+}
+
+// Send the chunks of a file with RPC. The chunks are sent without waiting for each of them
+// to be acknowledged, but at most window of them at a time. Returns the hash of the file.
+func (migration *MigrationDonor) sendChunks(ctx context.Context, handle int, file *os.File, received map[int64]bool) (string, int64, int64, error) {
+	buf := make([]byte, ChunkSize)
+	hash := sha256.New()
+	done := make(chan *rpc.Call, migration.window)
+	inFlight := 0
+
+	var offset, raw, sent int64
+	var sendErr error
 	for {
+		if err := ctx.Err(); err != nil {
+			sendErr = err
+			break
+		}
+
 		n, err := file.Read(buf)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("Error while reading file: %v", err)
+			sendErr = fmt.Errorf("Error while reading file: %v", err)
+			break
 		}
 
-		err = migration.recipientClient.FileData(buf[:n])
+		hash.Write(buf[:n])
+
+		if received[offset] {
+			migration.progress.Sent(int64(n))
+			offset += int64(n)
+			continue
+		}
+
+		data, err := nymph.Compress(migration.compression, buf[:n])
 		if err != nil {
-			return fmt.Errorf("Error while sending data: %v", err)
+			sendErr = fmt.Errorf("Failed to compress data: %v", err)
+			break
 		}
+
+		if inFlight == migration.window {
+			call := <-done
+			inFlight--
+			if err := migration.recipientClient.FileDataDone(call); err != nil {
+				sendErr = fmt.Errorf("Error while sending data: %v", err)
+				break
+			}
+		}
+
+		migration.throttle(int64(len(data)))
+		migration.recipientClient.FileData(handle, offset, data, done)
+		inFlight++
+		migration.progress.Sent(int64(n))
+
+		offset += int64(n)
+		raw += int64(n)
+		sent += int64(len(data))
 	}
 
-	return nil
+	// Wait for the chunks, that are still in flight
+	for ; inFlight > 0; inFlight-- {
+		call := <-done
+		if err := migration.recipientClient.FileDataDone(call); err != nil && sendErr == nil {
+			sendErr = fmt.Errorf("Error while sending data: %v", err)
+		}
+	}
+
+	if sendErr != nil {
+		return "", 0, 0, sendErr
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), raw, sent, nil
 }
 
 func (migration *MigrationDonor) Relaunch() error {
+	return migration.relaunch(&container.RelaunchArgs{})
+}
+
+// Launch the container at the recipient, that fetches memory pages from the donor
+func (migration *MigrationDonor) RelaunchLazy(address string, port int) error {
+	return migration.relaunch(&container.RelaunchArgs{
+		LazyPagesAddress: address,
+		LazyPagesPort:    port,
+	})
+}
 
-	err := migration.recipientClient.Relaunch()
+func (migration *MigrationDonor) relaunch(args *container.RelaunchArgs) error {
+	migration.progress.Phase(coordinator.PhaseRestore)
+	args.MigrationID = migration.progress.ID()
+
+	migration.relaunchRequested = true
+	err := migration.recipientClient.Relaunch(args)
 	if err != nil {
 		log.WithError(err).Debug("Requested launch failed")
 		return fmt.Errorf("Failed to send launch request: %v", err)
 	}
 
+	migration.relaunched = true
 	return nil
 }
 
-func (migration *MigrationDonor) SendCheckpoint() error {
-	if err := migration.sendState(); err != nil {
+// Check, whether the container runs at the recipient. If the connection was lost during the
+// relaunch, the reply is unknown, so the donor resumes the session and asks the recipient.
+func (migration *MigrationDonor) Relaunched() (bool, error) {
+	if migration.relaunched || !migration.relaunchRequested || !migration.recipientClient.Lost() {
+		return migration.relaunched, nil
+	}
+
+	var err error
+	for attempt := 1; attempt <= migration.resumeAttempts; attempt++ {
+		time.Sleep(time.Duration(attempt) * resumeDelay)
+
+		migration.recipientClient.Close()
+
+		var state *container.SessionState
+		state, err = migration.connect()
+		if err == nil {
+			migration.relaunched = state.Relaunched
+			return state.Relaunched, nil
+		}
+
+		log.WithError(err).WithField("attempt", attempt).Warn("Failed to reconnect to the recipient")
+	}
+
+	return false, fmt.Errorf("Failed to ask the recipient about the relaunch: %v", err)
+}
+
+// Send the checkpoint together with the ancestors, that the recipient does not have yet.
+// The ancestors go first, so that the checkpoint is the last image of the session.
+func (migration *MigrationDonor) SendCheckpoint(checkpoint container.Checkpoint) error {
+	for _, ckpt := range container.Chain(checkpoint) {
+		if migration.sent[ckpt.Generation()] {
+			continue
+		}
+
+		if err := migration.sendGeneration(ckpt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Send a single generation to the recipient. If the connection is lost, the donor reconnects
+// and sends only what the recipient has not received yet.
+func (migration *MigrationDonor) sendGeneration(checkpoint container.Checkpoint) error {
+	migration.progress.Phase(coordinator.PhaseTransfer)
+	migration.progress.AddTotal(migration.checkpointSize(checkpoint))
+	base := migration.progress.BytesSent()
+
+	var resume map[string]container.FileState = nil
+	for attempt := 1; ; attempt++ {
+		// Every attempt counts the whole generation, either as sent, or as received before
+		migration.progress.Rewind(base)
+
+		err := migration.sendCheckpoint(checkpoint, resume)
+		if err == nil {
+			migration.sent[checkpoint.Generation()] = true
+			return nil
+		}
+
+		if !migration.recipientClient.Lost() {
+			return err
+		}
+
+		if attempt > migration.resumeAttempts {
+			return fmt.Errorf("Giving up after %v attempts: %v", attempt, err)
+		}
+
+		log.WithError(err).WithField("attempt", attempt).Warn("Connection to the recipient has been lost, resuming")
+
+		time.Sleep(time.Duration(attempt) * resumeDelay)
+
+		migration.recipientClient.Close()
+		state, err := migration.connect()
+		if err != nil {
+			// The closed client makes the next attempt fail right away and reconnect again
+			log.WithError(err).Warn("Failed to reconnect to the recipient")
+			resume = nil
+			continue
+		}
+
+		resume = nil
+		if state.HasImage && state.Image.ID == checkpoint.ContainerID() && state.Image.Generation == checkpoint.Generation() {
+			resume = state.Files
+		}
+	}
+}
+
+// Size of the files of the checkpoint, that are going to be sent
+func (migration *MigrationDonor) checkpointSize(checkpoint container.Checkpoint) int64 {
+	var size int64
+	if info, err := os.Stat(path.Join(migration.rootDir, checkpoint.StatePath())); err == nil {
+		size += info.Size()
+	}
+
+	files, err := ioutil.ReadDir(checkpoint.PathAbs())
+	if err != nil {
+		return size
+	}
+
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			size += file.Size()
+		}
+	}
+
+	return size
+}
+
+func (migration *MigrationDonor) sendCheckpoint(checkpoint container.Checkpoint, resume map[string]container.FileState) error {
+	migration.manifest = make(container.Manifest)
+	migration.rawBytes = 0
+	migration.sentBytes = 0
+	migration.resume = resume
+	start := time.Now()
+
+	if resume == nil {
+		if err := migration.recipientClient.ImageInfo(checkpoint.ImageInfo()); err != nil {
+			return err
+		}
+	}
+
+	if err := migration.sendState(checkpoint); err != nil {
 		return err
 	}
 
-	if err := migration.sendImage(); err != nil {
+	if err := migration.sendImage(checkpoint); err != nil {
 		return err
 	}
 
+	if err := migration.recipientClient.Manifest(migration.manifest); err != nil {
+		return fmt.Errorf("Checkpoint verification failed: %v", err)
+	}
+
+	migration.logTransfer(time.Since(start))
+
 	return nil
 }
 
+func (migration *MigrationDonor) logTransfer(elapsed time.Duration) {
+	ratio := 1.0
+	if migration.sentBytes > 0 {
+		ratio = float64(migration.rawBytes) / float64(migration.sentBytes)
+	}
+
+	throughput := 0.0
+	if elapsed > 0 {
+		throughput = float64(migration.rawBytes) / (1 << 20) / elapsed.Seconds()
+	}
+
+	log.WithFields(log.Fields{
+		"compression": migration.compression,
+		"raw":         migration.rawBytes,
+		"sent":        migration.sentBytes,
+		"ratio":       fmt.Sprintf("%.2f", ratio),
+		"throughput":  fmt.Sprintf("%.1f MiB/s", throughput),
+		"elapsed":     elapsed,
+	}).Info("Checkpoint has been transferred")
+}
+
+// Start a page server at the recipient, that receives memory pages of the checkpoint
+func (migration *MigrationDonor) StartPageServer(checkpoint container.Checkpoint) (*libcontainer.CriuPageServerInfo, error) {
+	parent := -1
+	if checkpoint.Parent() != nil {
+		parent = checkpoint.Parent().Generation()
+	}
+
+	port, err := migration.recipientClient.StartPageServer(&container.PageServerArgs{
+		ID:         checkpoint.ContainerID(),
+		Generation: checkpoint.Generation(),
+		Parent:     parent,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start page server: %v", err)
+	}
+
+	return &libcontainer.CriuPageServerInfo{
+		Address: migration.recipient,
+		Port:    int32(port),
+	}, nil
+}
+
+func (migration *MigrationDonor) FinishPageServer(abort bool) error {
+	return migration.recipientClient.FinishPageServer(abort)
+}
+
+// Send the checkpoint to the recipient, that keeps it without launching the container. The
+// recipient holds the ancestors from earlier replications already.
+func (migration *MigrationDonor) Replicate(checkpoint container.Checkpoint) error {
+	if err := migration.sendGeneration(checkpoint); err != nil {
+		return err
+	}
+
+	migration.replicated = true
+	return nil
+}
+
+// Finish the session. If the container has not been relaunched at the recipient, and the
+// checkpoint is not a replica, the recipient discards everything it has received.
 func (migration *MigrationDonor) Close() {
+	discard := !migration.relaunched && !migration.replicated
+	if err := migration.recipientClient.CloseSession(discard); err != nil {
+		log.WithError(err).WithField("session", migration.session).Warn("Failed to close transfer session")
+	}
+
 	migration.recipientClient.Close()
+	migration.progress.Close()
 }
@@ -1,56 +1,107 @@
 package nymph
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/exec"
 	"path"
-	"time"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/planetA/konk/config"
 	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/nymph"
+	"github.com/planetA/konk/pkg/util"
 )
 
 type Recipient struct {
-	nymph      *Nymph
-	imageInfo  container.ImageInfoArgs
-	rank       container.Rank
-	id         string
-	seq        int
-	generation int
-	args       []string
+	nymph *Nymph
 
-	// Current file data
-	Filename string
-	Size     int64
-	Mode     os.FileMode
-	ModTime  time.Time
+	// Accepts data channels of donors
+	dataListener net.Listener
 
-	File    *os.File
-	ToWrite int64
+	// Transfer sessions by ID
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+// A file, that is being received. Chunks may arrive in any order and, after the donor
+// reconnects, more than once.
+type incomingFile struct {
+	mutex       sync.Mutex
+	filename    string
+	file        *os.File
+	size        int64
+	written     int64
+	chunks      map[int64]bool
+	compression string
 }
 
 func NewRecipient(nymph *Nymph) (*Recipient, error) {
+	port, _ := config.GetIntOk(config.NymphMigrationDataPort)
+	dataListener, err := util.CreateListener(port)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open data channel port: %v", err)
+	}
+
 	return &Recipient{
-		nymph: nymph,
-		seq:   4,
+		nymph:        nymph,
+		dataListener: dataListener,
+		sessions:     make(map[string]*session),
 	}, nil
 }
 
-func (r *Recipient) ImageInfo(args container.ImageInfoArgs, seq *int) error {
+// Pick the first of the compressions offered by the donor, that the recipient supports
+func (r *Recipient) Negotiate(args container.NegotiateArgs, compression *string) error {
+	for _, offered := range args.Compressions {
+		if SupportsCompression(offered) {
+			*compression = offered
+			return nil
+		}
+	}
+
+	return fmt.Errorf("None of the compressions is supported: %v", args.Compressions)
+}
+
+func (r *Recipient) ImageInfo(args container.CheckpointInfoArgs, reply *bool) error {
 	log.WithFields(log.Fields{
-		"rank": args.Rank,
-		"id":   args.ID,
+		"session": args.Session,
+		"rank":    args.Image.Rank,
+		"id":      args.Image.ID,
 	}).Debug("Received image info")
 
-	r.imageInfo = args
+	s, err := r.getSession(args.Session)
+	if err != nil {
+		return err
+	}
+
+	// The files would replace the state of the running container
+	if _, err := r.nymph.Containers.Get(args.Image.Rank); err == nil {
+		return fmt.Errorf("Container %v runs at the recipient already", args.Image.Rank)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	*seq = r.seq
-	r.seq = r.seq + 1
+	// Files of an interrupted transfer are not going to be finished
+	s.dropFiles()
+
+	s.hasImage = true
+	s.imageInfo = args.Image
+	s.manifest = make(container.Manifest)
+	s.verified = false
+	s.dirs[container.CheckpointPath(args.Image.ID, args.Image.Generation)] = true
+
+	*reply = true
 	return nil
 }
 
-func (r *Recipient) LinkInfo(args container.LinkInfoArgs, seq *int) error {
+func (r *Recipient) LinkInfo(args container.LinkInfoArgs, reply *bool) error {
 	log.WithFields(log.Fields{
 		"file": args.Filename,
 		"link": args.Link,
@@ -59,12 +110,9 @@ func (r *Recipient) LinkInfo(args container.LinkInfoArgs, seq *int) error {
 		"time": args.ModTime,
 	}).Debug("Received link info")
 
-	if r.File != nil {
-		log.WithFields(log.Fields{
-			"file":     r.File.Name(),
-			"to_write": r.ToWrite,
-		}).Error("Found unfinished file")
-		return fmt.Errorf("Found unfinished file")
+	s, err := r.getSession(args.Session)
+	if err != nil {
+		return err
 	}
 
 	fullpath := path.Join(r.nymph.RootDir, args.Filename)
@@ -79,6 +127,9 @@ func (r *Recipient) LinkInfo(args container.LinkInfoArgs, seq *int) error {
 		return err
 	}
 
+	// The link may exist already, if the transfer has been resumed
+	os.Remove(fullpath)
+
 	if err := os.Symlink(args.Link, fullpath); err != nil {
 		log.WithFields(log.Fields{
 			"file":  fullpath,
@@ -88,12 +139,18 @@ func (r *Recipient) LinkInfo(args container.LinkInfoArgs, seq *int) error {
 		return fmt.Errorf("Failed to create symlink (%s) -> (%s): %v", args.Link, args.Filename, err)
 	}
 
-	*seq = r.seq
-	r.seq = r.seq + 1
+	linkHash := sha256.Sum256([]byte(args.Link))
+
+	s.mutex.Lock()
+	s.manifest[args.Filename] = hex.EncodeToString(linkHash[:])
+	s.mutex.Unlock()
+
+	*reply = true
 	return nil
 }
 
-func (r *Recipient) FileInfo(args container.FileInfoArgs, seq *int) error {
+// Start receiving a file. Returns the handle, that the chunks of the file refer to.
+func (r *Recipient) FileInfo(args container.FileInfoArgs, handle *int) error {
 	log.WithFields(log.Fields{
 		"file": args.Filename,
 		"size": args.Size,
@@ -101,21 +158,12 @@ func (r *Recipient) FileInfo(args container.FileInfoArgs, seq *int) error {
 		"time": args.ModTime,
 	}).Debug("Received file info")
 
-	r.Filename = args.Filename
-	r.Size = args.Size
-	r.Mode = args.Mode
-	r.ModTime = args.ModTime
-
-	if r.File != nil {
-		log.WithFields(log.Fields{
-			"file":     r.File.Name(),
-			"to_write": r.ToWrite,
-		}).Error("Found unfinished file")
-		return fmt.Errorf("Found unfinished file")
+	s, err := r.getSession(args.Session)
+	if err != nil {
+		return err
 	}
 
-	var err error
-	fullpath := path.Join(r.nymph.RootDir, r.Filename)
+	fullpath := path.Join(r.nymph.RootDir, args.Filename)
 
 	dir, _ := path.Split(fullpath)
 	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
@@ -127,33 +175,79 @@ func (r *Recipient) FileInfo(args container.FileInfoArgs, seq *int) error {
 		return err
 	}
 
-	r.File, err = os.OpenFile(fullpath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, r.Mode)
+	file, err := os.OpenFile(fullpath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, args.Mode)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"file":  fullpath,
 			"error": err,
 		}).Debug("Failed to create file")
-		return fmt.Errorf("Failed to create file (%s): %v", r.Filename, err)
+		return fmt.Errorf("Failed to create file (%s): %v", args.Filename, err)
+	}
+
+	incoming := &incomingFile{
+		filename:    args.Filename,
+		file:        file,
+		size:        args.Size,
+		chunks:      make(map[int64]bool),
+		compression: args.Compression,
 	}
 
-	r.ToWrite = r.Size
+	s.mutex.Lock()
+	*handle = s.nextHandle
+	s.nextHandle = s.nextHandle + 1
+	s.files[*handle] = incoming
+	s.mutex.Unlock()
+
+	// Empty files get no data
+	if incoming.size == 0 {
+		return r.finishFile(s, *handle, incoming)
+	}
 
-	*seq = r.seq
-	r.seq = r.seq + 1
 	return nil
 }
 
-func (r *Recipient) FileData(args container.FileDataArgs, seq *int) error {
-	dataLen := int64(len(args.Data))
-	if r.ToWrite < dataLen {
+func (r *Recipient) FileData(args container.FileDataArgs, reply *bool) error {
+	s, err := r.getSession(args.Session)
+	if err != nil {
+		return err
+	}
+
+	incoming, err := s.file(args.Handle)
+	if err != nil {
+		return err
+	}
+
+	if err := r.storeChunk(s, args.Handle, incoming, args.Offset, args.Data); err != nil {
+		return err
+	}
+
+	*reply = true
+	return nil
+}
+
+// Write a chunk, that may be compressed, into the file
+func (r *Recipient) storeChunk(s *session, handle int, incoming *incomingFile, offset int64, chunk []byte) error {
+	if offset < 0 || offset >= incoming.size {
+		return fmt.Errorf("Unexpected offset %v in %s", offset, incoming.filename)
+	}
+
+	data, err := Decompress(incoming.compression, chunk, incoming.size-offset)
+	if err != nil {
+		log.WithError(err).WithField("file", incoming.filename).Error("Failed to decompress data")
+		return fmt.Errorf("Failed to decompress data of %s: %v", incoming.filename, err)
+	}
+
+	dataLen := int64(len(data))
+	if offset+dataLen > incoming.size {
 		log.WithFields(log.Fields{
-			"size":     dataLen,
-			"to_write": r.ToWrite,
+			"size":   dataLen,
+			"offset": offset,
+			"file":   incoming.size,
 		}).Error("Unexpected buffer size")
 		return fmt.Errorf("Unexpected buffer size")
 	}
 
-	written, err := r.File.Write(args.Data)
+	written, err := incoming.file.WriteAt(data, offset)
 	if err != nil {
 		return fmt.Errorf("Failed to write the file: %v", err)
 	}
@@ -162,64 +256,207 @@ func (r *Recipient) FileData(args container.FileDataArgs, seq *int) error {
 		return fmt.Errorf("Not all data has been written")
 	}
 
-	r.ToWrite = r.ToWrite - dataLen
+	return r.chunkWritten(s, handle, incoming, offset, dataLen)
+}
 
-	if r.ToWrite == 0 {
-		r.File.Close()
+// Account for a chunk, that has been written, and finish the file after its last chunk
+func (r *Recipient) chunkWritten(s *session, handle int, incoming *incomingFile, offset int64, length int64) error {
+	incoming.mutex.Lock()
+	if !incoming.chunks[offset] {
+		incoming.chunks[offset] = true
+		incoming.written = incoming.written + length
+	}
+	complete := incoming.written == incoming.size
+	incoming.mutex.Unlock()
 
-		r.File = nil
-		r.Filename = ""
+	if complete {
+		return r.finishFile(s, handle, incoming)
 	}
 
-	*seq = r.seq
-	r.seq = r.seq + 1
 	return nil
 }
 
-func (r *Recipient) Relaunch(args container.RelaunchArgs, seq *int) error {
-	// Load container from checkpoint
+// All chunks of the file have been written. The hash is computed from the file on disk,
+// because the chunks arrive in arbitrary order.
+func (r *Recipient) finishFile(s *session, handle int, incoming *incomingFile) error {
+	s.mutex.Lock()
+	if s.files[handle] != incoming {
+		// Another request has finished the file already
+		s.mutex.Unlock()
+		return nil
+	}
+	delete(s.files, handle)
+	s.mutex.Unlock()
 
-	cont, err := r.nymph.Containers.Load(r.imageInfo)
+	incoming.file.Close()
+
+	hash, err := hashFile(path.Join(r.nymph.RootDir, incoming.filename))
+	if err != nil {
+		return fmt.Errorf("Failed to hash %s: %v", incoming.filename, err)
+	}
+
+	s.mutex.Lock()
+	s.manifest[incoming.filename] = hash
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func hashFile(fullpath string) (string, error) {
+	file, err := os.Open(fullpath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Verify the received files against the manifest of the donor. A checkpoint, that does not
+// match, is never restored.
+func (r *Recipient) Manifest(args container.ManifestArgs, reply *bool) error {
+	s, err := r.getSession(args.Session)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"id":   r.id,
-			"rank": r.rank,
-		}).Error("Loading container has failed")
 		return err
 	}
 
-	for _, net := range r.nymph.networks {
-		if external, ok := net.DeclareExternal(cont.Rank()); ok {
-			cont.AddExternal(external)
-		}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.files) > 0 {
+		return fmt.Errorf("Found %v unfinished files", len(s.files))
 	}
 
-	if err := cont.Launch(container.Restore, cont.Args(), true); err != nil {
+	if hash := args.Files.Hash(); hash != args.Hash {
+		log.WithFields(log.Fields{
+			"expected": args.Hash,
+			"got":      hash,
+		}).Error("Manifest is corrupted")
+		return fmt.Errorf("Manifest is corrupted: expected hash %s, got %s", args.Hash, hash)
+	}
+
+	if err := s.manifest.Verify(args.Files); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"rank":       s.imageInfo.Rank,
+			"generation": s.imageInfo.Generation,
+		}).Error("Checkpoint verification failed")
 		return err
 	}
 
-	for _, net := range r.nymph.networks {
-		if err := net.PostRestore(cont); err != nil {
-			return err
-		}
+	log.WithFields(log.Fields{
+		"files":          len(args.Files),
+		"hash":           args.Hash,
+		"pages-verified": !s.pagesUnverified,
+	}).Debug("Checkpoint has been verified")
+
+	s.verified = true
+
+	*reply = true
+	return nil
+}
+
+func (r *Recipient) Relaunch(args container.RelaunchArgs, reply *bool) error {
+	s, err := r.getSession(args.Session)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	verified := s.verified
+	imageInfo := s.imageInfo
+	busy := s.relaunched || s.relaunching != nil
+	// A donor, that lost the connection, learns the outcome, once it resumes the session
+	done := make(chan struct{})
+	if verified && !busy {
+		s.relaunching = done
+	}
+	s.mutex.Unlock()
+
+	if !verified {
+		return fmt.Errorf("Checkpoint of rank %v has not been verified", imageInfo.Rank)
 	}
 
-	status, err := cont.Status()
+	if busy {
+		return fmt.Errorf("Container %v has been relaunched already", imageInfo.Rank)
+	}
+
+	err = r.loadAndRelaunch(imageInfo, args)
+
+	s.mutex.Lock()
+	s.relaunched = err == nil
+	s.relaunching = nil
+	s.mutex.Unlock()
+	close(done)
+
 	if err != nil {
-		log.WithError(err).Error("Quering status failed")
 		return err
 	}
 
-	// Remember old ID
+	*reply = true
+	return nil
+}
 
-	log.WithFields(log.Fields{
-		"cont":   cont.ID(),
-		"status": status,
-	}).Debug("Container has been restored")
+func (r *Recipient) loadAndRelaunch(imageInfo container.ImageInfoArgs, args container.RelaunchArgs) error {
+	// Load container from checkpoint
+
+	cont, err := r.nymph.Containers.Load(imageInfo)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":   imageInfo.ID,
+			"rank": imageInfo.Rank,
+		}).Error("Loading container has failed")
+		return err
+	}
+
+	if err := r.relaunch(cont, imageInfo, args); err != nil {
+		// The donor is going to restore the container, so no trace of it should stay here
+		log.WithError(err).WithField("rank", cont.Rank()).Error("Relaunch failed, dropping the container")
+		r.nymph.Containers.Delete(cont)
+		return err
+	}
 
 	return nil
 }
 
+func (r *Recipient) relaunch(cont *container.Container, imageInfo container.ImageInfoArgs, args container.RelaunchArgs) error {
+	var err error
+
+	startType := container.Restore
+	var lazyPages *exec.Cmd
+	if args.LazyPagesAddress != "" {
+		imagesDir := path.Join(r.nymph.RootDir, container.CheckpointPath(imageInfo.ID, imageInfo.Generation))
+		lazyPages, err = startLazyPages(imagesDir, args.LazyPagesAddress, args.LazyPagesPort)
+		if err != nil {
+			return err
+		}
+
+		startType = container.RestoreLazy
+	}
+
+	progress := r.nymph.newProgress(args.MigrationID)
+	defer progress.Close()
+
+	err = r.nymph.restoreContainer(cont, startType, progress)
+	if err != nil && lazyPages != nil {
+		lazyPages.Process.Kill()
+	}
+
+	return err
+}
+
 func (r *Recipient) _Close() {
+	r.dataListener.Close()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
+	for id, s := range r.sessions {
+		s.close(r.nymph.RootDir, false)
+		delete(r.sessions, id)
+	}
 }
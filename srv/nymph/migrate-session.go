@@ -0,0 +1,260 @@
+package nymph
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/config"
+	"github.com/planetA/konk/pkg/container"
+)
+
+const (
+	// Sessions without requests for that long are discarded, if not configured otherwise
+	defaultSessionTimeout = 10 * time.Minute
+	sessionCheckInterval  = 30 * time.Second
+)
+
+// Everything the recipient knows about a migration from one donor. The session survives a
+// lost connection, so that the donor can reconnect and resume the transfer.
+type session struct {
+	id string
+	// Protected by the mutex of the recipient
+	lastActive time.Time
+
+	// Protects the state below, because requests of a session are handled concurrently
+	mutex sync.Mutex
+
+	// Checkpoint, that is being received
+	hasImage  bool
+	imageInfo container.ImageInfoArgs
+
+	// Files, that are being received, by handle
+	files      map[int]*incomingFile
+	nextHandle int
+
+	// Hashes of the received files and whether they match the manifest of the donor
+	manifest container.Manifest
+	verified bool
+	// Memory pages were written by a page server, the manifest does not cover them
+	pagesUnverified bool
+
+	relaunched bool
+	// Closed, once the relaunch in progress finishes
+	relaunching chan struct{}
+
+	// Checkpoint directories written during the session
+	dirs map[string]bool
+
+	pageServer *pageServer
+}
+
+func newSession(id string) *session {
+	return &session{
+		id:         id,
+		lastActive: time.Now(),
+		files:      make(map[int]*incomingFile),
+		manifest:   make(container.Manifest),
+		dirs:       make(map[string]bool),
+	}
+}
+
+// Close files, that are not going to be finished. Must be called with the mutex held.
+func (s *session) dropFiles() {
+	for handle, incoming := range s.files {
+		log.WithField("file", incoming.filename).Warn("Dropping unfinished file")
+		incoming.file.Close()
+		delete(s.files, handle)
+	}
+}
+
+// Find a file, that is being received
+func (s *session) file(handle int) (*incomingFile, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	incoming, ok := s.files[handle]
+	if !ok {
+		return nil, fmt.Errorf("Unknown file handle: %v", handle)
+	}
+
+	return incoming, nil
+}
+
+// What has been received so far. Must be called with the mutex held.
+func (s *session) state() container.SessionState {
+	state := container.SessionState{
+		HasImage:   s.hasImage,
+		Image:      s.imageInfo,
+		Files:      make(map[string]container.FileState),
+		Relaunched: s.relaunched,
+	}
+
+	for filename := range s.manifest {
+		state.Files[filename] = container.FileState{
+			Complete: true,
+		}
+	}
+
+	for handle, incoming := range s.files {
+		incoming.mutex.Lock()
+		chunks := make([]int64, 0, len(incoming.chunks))
+		for offset := range incoming.chunks {
+			chunks = append(chunks, offset)
+		}
+		incoming.mutex.Unlock()
+
+		state.Files[incoming.filename] = container.FileState{
+			Handle: handle,
+			Chunks: chunks,
+		}
+	}
+
+	return state
+}
+
+// Release everything the session holds. Unless the container has been relaunched, the
+// received checkpoints can be removed. Must be called with the mutex held.
+func (s *session) close(rootDir string, discard bool) {
+	s.dropFiles()
+
+	if s.pageServer != nil {
+		s.pageServer.finish(true)
+		s.pageServer = nil
+	}
+
+	if !discard || s.relaunched {
+		return
+	}
+
+	for dir := range s.dirs {
+		log.WithFields(log.Fields{
+			"session": s.id,
+			"dir":     dir,
+		}).Debug("Removing checkpoint of unfinished migration")
+
+		if err := os.RemoveAll(path.Join(rootDir, dir)); err != nil {
+			log.WithError(err).WithField("dir", dir).Warn("Failed to remove checkpoint")
+		}
+	}
+}
+
+// Find the session of a request and mark it as active
+func (r *Recipient) getSession(id string) (*session, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown session: %v", id)
+	}
+
+	s.lastActive = time.Now()
+	return s, nil
+}
+
+// Open a new session or resume an existing one. Returns what has been received so far. If
+// the container is being relaunched, the reply waits until the relaunch finishes.
+func (r *Recipient) OpenSession(args container.OpenSessionArgs, reply *container.SessionState) error {
+	if args.Session == "" {
+		return fmt.Errorf("Session ID is empty")
+	}
+
+	r.mutex.Lock()
+	s, ok := r.sessions[args.Session]
+	if !ok {
+		s = newSession(args.Session)
+		r.sessions[args.Session] = s
+	}
+	s.lastActive = time.Now()
+	r.mutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"session": args.Session,
+		"resumed": ok,
+	}).Debug("Opened transfer session")
+
+	s.mutex.Lock()
+	relaunching := s.relaunching
+	s.mutex.Unlock()
+
+	if relaunching != nil {
+		<-relaunching
+	}
+
+	s.mutex.Lock()
+	*reply = s.state()
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (r *Recipient) CloseSession(args container.CloseSessionArgs, reply *bool) error {
+	r.mutex.Lock()
+	s, ok := r.sessions[args.Session]
+	delete(r.sessions, args.Session)
+	r.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Unknown session: %v", args.Session)
+	}
+
+	log.WithFields(log.Fields{
+		"session": args.Session,
+		"discard": args.Discard,
+	}).Debug("Closing transfer session")
+
+	s.mutex.Lock()
+	s.close(r.nymph.RootDir, args.Discard)
+	s.mutex.Unlock()
+
+	*reply = true
+	return nil
+}
+
+func getSessionTimeout() time.Duration {
+	if seconds, ok := config.GetIntOk(config.NymphMigrationSessionTimeout); ok && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return defaultSessionTimeout
+}
+
+// Discard sessions, whose donors have gone away without finishing the migration
+func (r *Recipient) collectSessions(ctx context.Context) {
+	timeout := getSessionTimeout()
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		expired := make([]*session, 0)
+
+		r.mutex.Lock()
+		for id, s := range r.sessions {
+			if time.Since(s.lastActive) > timeout {
+				expired = append(expired, s)
+				delete(r.sessions, id)
+			}
+		}
+		r.mutex.Unlock()
+
+		for _, s := range expired {
+			log.WithField("session", s.id).Warn("Transfer session has expired")
+
+			s.mutex.Lock()
+			s.close(r.nymph.RootDir, true)
+			s.mutex.Unlock()
+		}
+	}
+}
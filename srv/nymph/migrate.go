@@ -1,25 +1,31 @@
 package nymph
 
 import (
+	"fmt"
+	"net"
+	"os"
 	"time"
 
+	"github.com/opencontainers/runc/libcontainer"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/planetA/konk/config"
 	"github.com/planetA/konk/pkg/container"
+	"github.com/planetA/konk/pkg/coordinator"
 	. "github.com/planetA/konk/pkg/nymph"
 )
 
-func (n *Nymph) sendCheckpoint(checkpoint container.Checkpoint, dest string, launch bool) error {
-	// Establish connection to recipient
-	migration, err := NewMigrationDonor(n.RootDir, checkpoint, dest)
-	if err != nil {
-		return err
-	}
-	defer migration.Close()
+const (
+	// Limit of pre-dump rounds, if the request does not set it
+	defaultMaxPreDumps = 5
+	// Pre-dumps are considered converged, once a round writes that many pages or less
+	defaultConvergencePages = 1024
+)
 
+func (n *Nymph) sendCheckpoint(migration *MigrationDonor, checkpoint container.Checkpoint, launch bool) error {
 	// Send the checkpoint
 	start := time.Now()
-	err = migration.SendCheckpoint()
+	err := migration.SendCheckpoint(checkpoint)
 	if err != nil {
 		log.WithError(err).Debug("Checkpoint send failed")
 		return err
@@ -27,36 +33,406 @@ func (n *Nymph) sendCheckpoint(checkpoint container.Checkpoint, dest string, lau
 
 	log.WithField("elapsed", time.Since(start)).Info("Checkpoint has been sent")
 
-	if launch {
-		// Launch remote checkpoint
-		err = migration.Relaunch()
+	if !launch {
+		return nil
+	}
+
+	// Launch remote checkpoint
+	err = migration.Relaunch()
+	if err != nil {
+		log.WithError(err).Debug("Relaunch failed")
+		return err
+	}
+
+	log.WithField("elapsed", time.Since(start)).Info("Relaunch finished")
+
+	return nil
+}
+
+// Dump the checkpoint. If requested, memory pages go directly to a page server at the
+// recipient, otherwise they are stored locally and sent later with the rest of the image.
+func (n *Nymph) dumpCheckpoint(migration *MigrationDonor, checkpoint container.Checkpoint, preDump bool, opts container.MigrationOpts) (container.DumpStats, error) {
+	dumpOpts := container.DumpOpts{
+		PreDump: preDump,
+	}
+
+	if preDump {
+		migration.progress.Phase(coordinator.PhasePreDump)
+	} else {
+		migration.progress.Phase(coordinator.PhaseDump)
+	}
+
+	if opts.PageServer {
+		pageServer, err := migration.StartPageServer(checkpoint)
 		if err != nil {
-			log.WithError(err).Debug("Checkpoint send failed")
+			return container.DumpStats{}, err
+		}
+		dumpOpts.PageServer = pageServer
+	}
+
+	start := time.Now()
+	err := checkpoint.Dump(dumpOpts)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"path":  checkpoint.PathAbs(),
+			"rank":  checkpoint.Rank(),
+		}).Debug("Checkpoint requested")
+	}
+
+	if opts.PageServer {
+		if finishErr := migration.FinishPageServer(err != nil); finishErr != nil && err == nil {
+			err = finishErr
+		}
+	}
+
+	elapsed := time.Since(start)
+	if err != nil {
+		return container.DumpStats{}, err
+	}
+
+	stats, statsErr := checkpoint.Stats()
+	if statsErr != nil {
+		log.WithError(statsErr).Warn("Failed to read dump statistics")
+		stats = &container.DumpStats{Generation: checkpoint.Generation()}
+	}
+	stats.PreDump = preDump
+	stats.Elapsed = elapsed
+
+	log.WithFields(log.Fields{
+		"elapsed":       elapsed,
+		"pre-dump":      preDump,
+		"page-server":   opts.PageServer,
+		"pages-written": stats.PagesWritten,
+	}).Info("Checkpoint has been dumped")
+
+	return *stats, nil
+}
+
+// Repeat pre-dumps, each based on the previous one, and send them to the recipient. Stop once
+// the number of pages dirtied since the previous round drops below the threshold, stops
+// decreasing, or the round limit is reached. Returns the last pre-dump.
+func (n *Nymph) iterativePreDump(migration *MigrationDonor, cont *container.Container, opts container.MigrationOpts, reply *SendReply) (container.Checkpoint, error) {
+	maxPreDumps := opts.MaxPreDumps
+	if maxPreDumps <= 0 {
+		maxPreDumps = defaultMaxPreDumps
+	}
+
+	convergencePages := opts.ConvergencePages
+	if convergencePages == 0 {
+		convergencePages = defaultConvergencePages
+	}
+
+	var checkpoint container.Checkpoint = nil
+	for round := 1; round <= maxPreDumps; round++ {
+		next, err := cont.NewCheckpoint(checkpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		stats, err := n.dumpCheckpoint(migration, next, true, opts)
+		if err != nil {
+			return nil, err
+		}
+		reply.Dumps = append(reply.Dumps, stats)
+
+		if err := n.sendCheckpoint(migration, next, false); err != nil {
+			return nil, err
+		}
+		checkpoint = next
+
+		log.WithFields(log.Fields{
+			"round":         round,
+			"pages-written": stats.PagesWritten,
+			"threshold":     convergencePages,
+		}).Debug("Pre-dump round finished")
+
+		if stats.PagesWritten <= convergencePages {
+			log.WithField("round", round).Info("Pre-dumps converged")
+			break
+		}
+
+		if round > 1 && stats.PagesWritten >= reply.Dumps[len(reply.Dumps)-2].PagesWritten {
+			log.WithField("round", round).Info("Pre-dumps do not converge")
+			break
+		}
+	}
+
+	return checkpoint, nil
+}
+
+// Make the lazy dump stop waiting for the recipient by connecting to it and hanging up
+func abortLazyDump(port int) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", port))
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
+
+// Start the lazy dump at a free port and wait, until it serves pages. Returns the port and
+// the channel, that receives the result of the dump.
+func startLazyDump(checkpoint container.Checkpoint) (int, chan error, error) {
+	port, err := freePort()
+	if err != nil {
+		return 0, nil, fmt.Errorf("Failed to find a free port: %v", err)
+	}
+
+	statusRead, statusWrite, err := os.Pipe()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer statusRead.Close()
+	defer statusWrite.Close()
+
+	dumpDone := make(chan error, 1)
+	go func() {
+		dumpDone <- checkpoint.Dump(container.DumpOpts{
+			LazyPages: true,
+			StatusFd:  fmt.Sprintf("/proc/self/fd/%d", statusWrite.Fd()),
+			PageServer: &libcontainer.CriuPageServerInfo{
+				Address: "0.0.0.0",
+				Port:    int32(port),
+			},
+		})
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := statusRead.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-dumpDone:
+		if err == nil {
+			err = fmt.Errorf("Lazy dump has finished before serving pages")
+		}
+		return 0, nil, err
+	case err := <-ready:
+		if err != nil {
+			abortLazyDump(port)
+			return 0, nil, fmt.Errorf("Failed to wait for lazy dump: %v", err)
+		}
+	}
+
+	return port, dumpDone, nil
+}
+
+// Post-copy migration: the donor dumps the process without memory pages and serves the pages
+// on demand, while the recipient restores the process right away.
+func (n *Nymph) migrateLazy(migration *MigrationDonor, cont *container.Container) error {
+	migration.progress.Phase(coordinator.PhaseDump)
+
+	checkpoint, err := cont.NewCheckpoint(nil)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var port int
+	var dumpDone chan error
+	for attempt := 1; ; attempt++ {
+		port, dumpDone, err = startLazyDump(checkpoint)
+		if err == nil {
+			break
+		}
+
+		// A dump, that has failed before serving pages, leaves the process running. The
+		// port might have been taken by another process, so try another one.
+		if attempt >= portAttempts || cont.Stopped() {
 			return err
 		}
 
+		log.WithError(err).WithField("attempt", attempt).Warn("Lazy dump failed to start")
 	}
-	log.WithField("elapsed", time.Since(start)).Info("Relaunch finished")
 
+	log.WithField("elapsed", time.Since(start)).Info("Lazy dump is ready to serve pages")
+
+	if err := migration.SendCheckpoint(checkpoint); err != nil {
+		abortLazyDump(port)
+		return err
+	}
+
+	if err := migration.RelaunchLazy(n.hostname, port); err != nil {
+		abortLazyDump(port)
+		return err
+	}
+
+	log.WithField("elapsed", time.Since(start)).Info("Relaunch finished, serving pages")
+
+	// The dump finishes, once the recipient has fetched all pages
+	if err := <-dumpDone; err != nil {
+		return fmt.Errorf("Serving lazy pages failed: %v", err)
+	}
+
+	log.WithField("elapsed", time.Since(start)).Info("All pages have been served")
+
+	return nil
+}
+
+// Restore the dumped container at the donor and take care of it, as if it was relaunched
+func (n *Nymph) rollback(cont *container.Container) error {
+	for _, net := range n.networks {
+		if external, ok := net.DeclareExternal(cont.Rank()); ok {
+			cont.AddExternal(external)
+		}
+	}
+
+	if err := cont.Rollback(); err != nil {
+		return err
+	}
+
+	cont.CollectCheckpoints(cont.LatestCheckpoint())
+
+	n.watchContainer(cont)
+	n.startPeriodicCheckpoints(cont)
+
+	for _, net := range n.networks {
+		if err := net.PostRestore(cont); err != nil {
+			return err
+		}
+	}
+
+	log.WithField("rank", cont.Rank()).Info("Container has been restored at the donor")
+
+	return nil
+}
+
+// Handle a migration, that failed after the container was marked as migrating. If the
+// process has been dumped already, it is restored at the donor from the checkpoint, unless
+// the recipient runs it despite the error.
+func (n *Nymph) failMigration(migration *MigrationDonor, cont *container.Container, args *SendArgs, reply *SendReply, cause error) error {
+	if !cont.Stopped() {
+		// The process has survived, nothing to roll back
+		cont.SetMigrating(false)
+		return cause
+	}
+
+	var err error
+	if args.Opts.PageServer || args.MigrationType == container.LazyPages {
+		err = fmt.Errorf("Memory pages are not stored at the donor")
+	} else if relaunched, queryErr := migration.Relaunched(); queryErr != nil {
+		// Restoring here could leave a second copy running at the recipient
+		err = queryErr
+	} else if relaunched {
+		log.WithError(cause).WithField("rank", cont.Rank()).Warn("Connection lost, but the container runs at the recipient")
+
+		n.tombstones.AddMigrated(cont.Rank())
+		n.Containers.Delete(cont)
+		cont.CollectCheckpoints()
+		return nil
+	} else {
+		log.WithError(cause).WithField("rank", cont.Rank()).Warn("Migration failed, rolling back")
+		err = n.rollback(cont)
+	}
+
+	if err != nil {
+		log.WithError(err).WithField("rank", cont.Rank()).Error("Rollback failed, container is lost")
+		n.Containers.Delete(cont)
+		return fmt.Errorf("%v; rollback failed: %v", cause, err)
+	}
+
+	reply.RolledBack = true
+	reply.Error = cause.Error()
+	return nil
+}
+
+// Rate limits of a migration: its own one and the one shared by all migrations of the nymph.
+// Memory pages sent to a page server or fetched by a lazy restore are not limited.
+func (n *Nymph) migrationLimiters(rateLimit int) []*rateLimiter {
+	if rateLimit == 0 {
+		rateLimit, _ = config.GetIntOk(config.NymphMigrationRateLimit)
+	}
+
+	limiters := make([]*rateLimiter, 0, 2)
+	if limiter := newRateLimiter(rateLimit); limiter != nil {
+		limiters = append(limiters, limiter)
+	}
+	if n.rateLimiter != nil {
+		limiters = append(limiters, n.rateLimiter)
+	}
+
+	return limiters
+}
+
+func (n *Nymph) startSending(rank container.Rank) error {
+	n.sendingMutex.Lock()
+	defer n.sendingMutex.Unlock()
+
+	if n.sending[rank] {
+		return fmt.Errorf("Container %v is being dumped already", rank)
+	}
+
+	n.sending[rank] = true
 	return nil
 }
 
+func (n *Nymph) stopSending(rank container.Rank) {
+	n.sendingMutex.Lock()
+	defer n.sendingMutex.Unlock()
+
+	delete(n.sending, rank)
+	n.sendingDone.Broadcast()
+}
+
+// Wait, until the container is not dumped anymore, and keep new dumps from starting
+func (n *Nymph) waitSending(rank container.Rank) {
+	n.sendingMutex.Lock()
+	defer n.sendingMutex.Unlock()
+
+	for n.sending[rank] {
+		n.sendingDone.Wait()
+	}
+
+	n.sending[rank] = true
+}
+
 // Send the checkpoint to the receiving nymph
-func (n *Nymph) Send(args *SendArgs, reply *bool) error {
+func (n *Nymph) Send(args *SendArgs, reply *SendReply) error {
 	log.WithFields(log.Fields{
 		"host": args.Host,
 		"type": args.MigrationType,
+		"opts": args.Opts,
 	}).Debug("Received a request to send a checkpoint")
 
-	n.Containers.Mutex.Lock()
-	defer n.Containers.Mutex.Unlock()
-
-	cont, err := n.Containers.GetUnlocked(args.ContainerRank)
+	cont, err := n.Containers.Get(args.ContainerRank)
 	if err != nil {
 		log.WithError(err).WithField("rank", args.ContainerRank).Error("Container not found")
 		return err
 	}
 
+	// Different containers migrate concurrently, but each of them only once at a time
+	if err := n.startSending(args.ContainerRank); err != nil {
+		return err
+	}
+	defer n.stopSending(args.ContainerRank)
+
+	// Establish connection to recipient
+	migration, err := NewMigrationDonor(n.RootDir, args.Host, n.migrationLimiters(args.Opts.RateLimit), n.newProgress(args.MigrationID))
+	if err != nil {
+		return err
+	}
+	defer migration.Close()
+
+	// The donor never sees the pages, that CRIU sends to the recipient directly
+	reply.PagesUnverified = args.Opts.PageServer || args.MigrationType == container.LazyPages
+
+	if args.MigrationType == container.LazyPages {
+		cont.SetMigrating(true)
+
+		if err := n.migrateLazy(migration, cont); err != nil {
+			return n.failMigration(migration, cont, args, reply, err)
+		}
+
+		n.tombstones.AddMigrated(cont.Rank())
+		n.Containers.Delete(cont)
+		cont.CollectCheckpoints()
+
+		return nil
+	}
+
 	var checkpoint container.Checkpoint = nil
 	if args.MigrationType == container.PreDump || args.MigrationType == container.WithPreDump {
 		// If we need to make pre-dump checkpoint
@@ -67,50 +443,53 @@ func (n *Nymph) Send(args *SendArgs, reply *bool) error {
 			return err
 		}
 
-		if err := checkpoint.Dump(true); err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-				"path":  checkpoint.PathAbs(),
-				"rank":  args.ContainerRank,
-			}).Debug("Checkpoint requested")
+		stats, err := n.dumpCheckpoint(migration, checkpoint, true, args.Opts)
+		if err != nil {
 			return err
 		}
+		reply.Dumps = append(reply.Dumps, stats)
 
 		// Send without launching
-		if err := n.sendCheckpoint(checkpoint, args.Host, false); err != nil {
+		if err := n.sendCheckpoint(migration, checkpoint, false); err != nil {
 			return err
 		}
 	}
 
-	if args.MigrationType == container.WithPreDump {
-		time.Sleep(2 * time.Second)
+	if args.MigrationType == container.IterativePreDump {
+		checkpoint, err = n.iterativePreDump(migration, cont, args.Opts, reply)
+		if err != nil {
+			return err
+		}
 	}
 
-	if args.MigrationType == container.Migrate || args.MigrationType == container.WithPreDump {
+	if args.MigrationType == container.Migrate || args.MigrationType == container.WithPreDump || args.MigrationType == container.IterativePreDump {
 		// Initiate new checkpoint. If there was parent, we use it.
 		checkpoint, err = cont.NewCheckpoint(checkpoint)
 		if err != nil {
 			return err
 		}
 
+		// The process is going to stop, but waiters should follow it to the new place
+		cont.SetMigrating(true)
+
 		// Second checkpoint without predump (or first of pre-dump is off)
-		if err := checkpoint.Dump(false); err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-				"path":  checkpoint.PathAbs(),
-				"rank":  args.ContainerRank,
-			}).Debug("Checkpoint requested")
-			return err
+		stats, err := n.dumpCheckpoint(migration, checkpoint, false, args.Opts)
+		if err != nil {
+			return n.failMigration(migration, cont, args, reply, err)
 		}
+		reply.Dumps = append(reply.Dumps, stats)
 
-		// Now, send a checkpoint and launch it
-		if err := n.sendCheckpoint(checkpoint, args.Host, true); err != nil {
-			return err
+		// Now, send a checkpoint and launch it. If anything fails, the container is
+		// restored here.
+		if err := n.sendCheckpoint(migration, checkpoint, true); err != nil {
+			return n.failMigration(migration, cont, args, reply, err)
 		}
 
-		n.Containers.DeleteUnlocked(args.ContainerRank)
+		// The container runs at the recipient now
+		n.tombstones.AddMigrated(cont.Rank())
+		n.Containers.Delete(cont)
+		cont.CollectCheckpoints()
 	}
 
-	*reply = true
 	return nil
 }
@@ -0,0 +1,62 @@
+package nymph
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/planetA/konk/pkg/container"
+)
+
+func newTestNymph() *Nymph {
+	n := &Nymph{
+		sending: make(map[container.Rank]bool),
+	}
+	n.sendingDone = sync.NewCond(&n.sendingMutex)
+
+	return n
+}
+
+func TestWaitSendingWaitsForDump(t *testing.T) {
+	n := newTestNymph()
+
+	// A periodic checkpoint is being dumped
+	if err := n.startSending(1); err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		n.waitSending(1)
+		close(waited)
+	}()
+
+	// Other ranks are not held up
+	if err := n.startSending(2); err != nil {
+		t.Errorf("Dump of another rank rejected: %v", err)
+	}
+
+	select {
+	case <-waited:
+		t.Fatalf("Waited for a container, that is still dumped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	n.stopSending(1)
+
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatalf("Waiting did not end after the dump")
+	}
+
+	// The waiter holds the container now, no new dump starts
+	if err := n.startSending(1); err == nil {
+		t.Errorf("Dump started, while the container is held")
+	}
+
+	n.stopSending(1)
+	if err := n.startSending(1); err != nil {
+		t.Errorf("Dump rejected after the container was released: %v", err)
+	}
+}
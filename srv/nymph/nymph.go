@@ -48,6 +48,10 @@ func Run() error {
 		return fmt.Errorf("Nymph registration has failed: %v", err)
 	}
 
+	go nymph.heartbeatLoop(ctx)
+	go recipient.collectSessions(ctx)
+	go recipient.serveData()
+
 	if err := util.ServerLoop(listener); err != nil {
 		return err
 	}
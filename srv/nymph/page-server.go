@@ -0,0 +1,271 @@
+package nymph
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/config"
+	"github.com/planetA/konk/pkg/container"
+)
+
+const (
+	defaultCriuPath = "criu"
+
+	// How long to wait for the page server to start, or to exit after the dump has finished
+	pageServerTimeout = 10 * time.Second
+
+	// Attempts to listen at a free port, if another process takes the port first
+	portAttempts = 3
+
+	// The socket restore uses to talk to the lazy-pages daemon
+	lazyPagesSocket = "lazy-pages.socket"
+)
+
+// CRIU page server receiving memory pages of a checkpoint directly from the donor
+type pageServer struct {
+	cmd  *exec.Cmd
+	port int
+	done chan error
+}
+
+// Ask the kernel for a free port
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func criuPath() string {
+	criuPath, ok := config.GetStringOk(config.NymphCriuPath)
+	if !ok {
+		return defaultCriuPath
+	}
+
+	return criuPath
+}
+
+// Start a page server at a free port. Another process can take the port, before the page
+// server binds it, then the start is repeated with another port.
+func startPageServer(imagesDir string, parent int) (*pageServer, error) {
+	if err := os.MkdirAll(imagesDir, os.ModeDir|os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	var err error
+	for attempt := 1; attempt <= portAttempts; attempt++ {
+		var server *pageServer
+		if server, err = tryPageServer(imagesDir, parent); err == nil {
+			return server, nil
+		}
+
+		log.WithError(err).WithField("attempt", attempt).Warn("Page server failed to start")
+	}
+
+	return nil, err
+}
+
+// Start a page server and wait, until it listens. CRIU reports it through the status
+// descriptor.
+func tryPageServer(imagesDir string, parent int) (*pageServer, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find a free port: %v", err)
+	}
+
+	statusRead, statusWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer statusRead.Close()
+
+	criuPath := criuPath()
+
+	args := []string{
+		"page-server",
+		"--images-dir", imagesDir,
+		"--port", strconv.Itoa(port),
+		// The first of the extra files
+		"--status-fd", "3",
+	}
+	if parent != -1 {
+		args = append(args, "--prev-images-dir", path.Join("..", strconv.Itoa(parent)))
+	}
+
+	cmd := exec.Command(criuPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{statusWrite}
+
+	log.WithFields(log.Fields{
+		"criu": criuPath,
+		"args": args,
+	}).Debug("Starting page server")
+
+	err = cmd.Start()
+	// Only the page server writes the status, so reading fails, once it exits
+	statusWrite.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start page server: %v", err)
+	}
+
+	server := &pageServer{
+		cmd:  cmd,
+		port: port,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		server.done <- cmd.Wait()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := statusRead.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			server.finish(true)
+			return nil, fmt.Errorf("Page server has exited before listening at port %v: %v", port, err)
+		}
+	case <-time.After(pageServerTimeout):
+		server.finish(true)
+		return nil, fmt.Errorf("Page server did not start in time")
+	}
+
+	return server, nil
+}
+
+// Wait for the page server to exit. If the page server does not exit in time, or if the
+// dump has been aborted, the page server is killed.
+func (p *pageServer) finish(abort bool) error {
+	timeout := pageServerTimeout
+	if abort {
+		timeout = 0
+	}
+
+	select {
+	case err := <-p.done:
+		return err
+	case <-time.After(timeout):
+		p.cmd.Process.Kill()
+		<-p.done
+		if abort {
+			return nil
+		}
+		return fmt.Errorf("Page server did not finish in time")
+	}
+}
+
+// Start the lazy-pages daemon, that fetches memory pages from the donor on demand. Returns,
+// once the daemon is ready to serve the restore.
+func startLazyPages(imagesDir, address string, port int) (*exec.Cmd, error) {
+	args := []string{
+		"lazy-pages",
+		"--images-dir", imagesDir,
+		"--page-server",
+		"--address", address,
+		"--port", strconv.Itoa(port),
+	}
+
+	cmd := exec.Command(criuPath(), args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	log.WithField("args", args).Debug("Starting lazy-pages daemon")
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to start lazy-pages daemon: %v", err)
+	}
+
+	socketPath := path.Join(imagesDir, lazyPagesSocket)
+	deadline := time.Now().Add(pageServerTimeout)
+	for {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, fmt.Errorf("Lazy-pages daemon did not start in time")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The daemon exits, once all pages have been fetched
+	go func() {
+		err := cmd.Wait()
+		log.WithError(err).WithField("dir", imagesDir).Debug("Lazy-pages daemon has finished")
+	}()
+
+	return cmd, nil
+}
+
+// Start a page server, that stores memory pages into the checkpoint directory
+func (r *Recipient) StartPageServer(args container.PageServerArgs, reply *container.PageServerReply) error {
+	s, err := r.getSession(args.Session)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pageServer != nil {
+		return fmt.Errorf("Page server is already running")
+	}
+
+	checkpointPath := container.CheckpointPath(args.ID, args.Generation)
+	imagesDir := path.Join(r.nymph.RootDir, checkpointPath)
+	server, err := startPageServer(imagesDir, args.Parent)
+	if err != nil {
+		log.WithError(err).WithField("dir", imagesDir).Error("Page server failed")
+		return err
+	}
+
+	s.pageServer = server
+	s.pagesUnverified = true
+	s.dirs[checkpointPath] = true
+	reply.Port = server.port
+	return nil
+}
+
+func (r *Recipient) FinishPageServer(args container.FinishPageServerArgs, reply *bool) error {
+	s, err := r.getSession(args.Session)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	server := s.pageServer
+	s.pageServer = nil
+	s.mutex.Unlock()
+
+	if server == nil {
+		return fmt.Errorf("Page server is not running")
+	}
+
+	err = server.finish(args.Abort)
+	if err != nil {
+		return fmt.Errorf("Page server failed: %v", err)
+	}
+
+	*reply = true
+	return nil
+}
@@ -0,0 +1,307 @@
+package nymph
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/config"
+	"github.com/planetA/konk/pkg/container"
+	"github.com/planetA/konk/pkg/coordinator"
+)
+
+const (
+	// Number of generations kept, if the configuration does not set it
+	defaultCheckpointKeep = 3
+)
+
+// Checkpoints taken in the background, while the container runs. Every generation is based
+// on the previous one, until the chain has keep generations. Then a full dump starts a new
+// chain. The previous chain is kept, until the new one has keep generations, so that at
+// least the last keep generations are always at hand. Each generation is replicated to the
+// buddies, that hold the whole chain.
+type periodicCheckpoints struct {
+	nymph    *Nymph
+	cont     *container.Container
+	interval time.Duration
+	keep     int
+	// Storage directory of the rank, empty if the checkpoints stay at the nymph
+	storage string
+
+	chain []container.Checkpoint
+	// Buddies, that have every generation of the chain
+	replicas map[string]bool
+
+	// Head of the previous chain and the buddies holding it
+	previous         container.Checkpoint
+	previousReplicas map[string]bool
+	// Buddies, that still hold the dropped previous chain
+	dropped map[string]bool
+}
+
+// Interval of periodic checkpoints requested at launch. Zero takes the interval from the
+// configuration, a negative interval disables periodic checkpoints.
+func checkpointInterval(seconds int) time.Duration {
+	if seconds == 0 {
+		seconds, _ = config.GetIntOk(config.NymphCheckpointInterval)
+	}
+
+	if seconds <= 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// Start taking periodic checkpoints of the container, if it asks for them. Stops, once the
+// process exits or leaves the nymph.
+func (n *Nymph) startPeriodicCheckpoints(cont *container.Container) {
+	interval := cont.CheckpointInterval()
+	if interval <= 0 {
+		return
+	}
+
+	keep, ok := config.GetIntOk(config.NymphCheckpointKeep)
+	if !ok || keep < 1 {
+		keep = defaultCheckpointKeep
+	}
+
+	storage, _ := config.GetStringOk(config.NymphCheckpointStorage)
+	if storage != "" {
+		storage = path.Join(storage, fmt.Sprintf("rank-%v", cont.Rank()))
+	}
+
+	p := &periodicCheckpoints{
+		nymph:    n,
+		cont:     cont,
+		interval: interval,
+		keep:     keep,
+		storage:  storage,
+		chain:    make([]container.Checkpoint, 0, keep),
+		replicas: make(map[string]bool),
+	}
+
+	log.WithFields(log.Fields{
+		"rank":     cont.Rank(),
+		"interval": interval,
+		"keep":     keep,
+		"storage":  storage,
+	}).Debug("Starting periodic checkpoints")
+
+	go p.run()
+}
+
+func (p *periodicCheckpoints) run() {
+	stopped := make(chan struct{})
+	go func() {
+		p.cont.Wait()
+		close(stopped)
+	}()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+			// The process may have exited during the previous checkpoint
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+
+			if err := p.take(); err != nil {
+				log.WithError(err).WithField("rank", p.cont.Rank()).Warn("Periodic checkpoint failed")
+			}
+		}
+	}
+}
+
+// Dump the next generation, store it and tell the coordinator about it
+func (p *periodicCheckpoints) take() error {
+	n := p.nymph
+	rank := p.cont.Rank()
+
+	checkpoint, stats, start, err := p.dump()
+	if err != nil {
+		return err
+	}
+
+	// The container is not held back for replication, it may even migrate meanwhile
+	replicas := p.replicate(checkpoint)
+
+	log.WithFields(log.Fields{
+		"rank":          rank,
+		"generation":    checkpoint.Generation(),
+		"chain":         len(p.chain),
+		"elapsed":       stats.Elapsed,
+		"pages-written": stats.PagesWritten,
+	}).Info("Periodic checkpoint has been taken")
+
+	err = n.reportCheckpoint(&coordinator.ReportCheckpointArgs{
+		Rank:     rank,
+		Hostname: n.hostname,
+		Image:    *checkpoint.ImageInfo(),
+		Dir:      p.storage,
+		Replicas: replicas,
+		Created:  start,
+	})
+	if err != nil {
+		log.WithError(err).WithField("rank", rank).Warn("Failed to report the checkpoint")
+	}
+
+	p.collectCopies()
+
+	return nil
+}
+
+// Dump the next generation and store it. Only the dump itself and the local bookkeeping keep
+// the container from migrating.
+func (p *periodicCheckpoints) dump() (container.Checkpoint, *container.DumpStats, time.Time, error) {
+	n := p.nymph
+	rank := p.cont.Rank()
+
+	// A container, that is migrating, is skipped until the next tick
+	if err := n.startSending(rank); err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	defer n.stopSending(rank)
+
+	var parent container.Checkpoint
+	if len(p.chain) > 0 && len(p.chain) < p.keep {
+		parent = p.chain[len(p.chain)-1]
+	}
+
+	checkpoint, err := p.cont.NewCheckpoint(parent)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	start := time.Now()
+	if err := checkpoint.Dump(container.DumpOpts{LeaveRunning: true}); err != nil {
+		p.cont.RemoveCheckpoint(checkpoint.Generation())
+		return nil, nil, time.Time{}, err
+	}
+
+	stats, err := checkpoint.Stats()
+	if err != nil {
+		stats = &container.DumpStats{Generation: checkpoint.Generation()}
+	}
+	stats.Elapsed = time.Since(start)
+
+	if p.storage != "" {
+		if _, err := n.storeCheckpoint(checkpoint, p.storage, *stats); err != nil {
+			os.RemoveAll(container.StoredImagesPath(p.storage, checkpoint.Generation()))
+			p.cont.RemoveCheckpoint(checkpoint.Generation())
+			return nil, nil, time.Time{}, err
+		}
+	}
+
+	if parent == nil {
+		if len(p.chain) > 0 {
+			p.previous = p.chain[len(p.chain)-1]
+			p.previousReplicas = p.replicas
+		}
+
+		p.chain = []container.Checkpoint{checkpoint}
+		// Every buddy gets a chance with the new chain
+		p.replicas = make(map[string]bool)
+		for _, buddy := range n.checkpointBuddies() {
+			p.replicas[buddy] = true
+		}
+	} else {
+		p.chain = append(p.chain, checkpoint)
+	}
+
+	// Once the chain is complete, the previous chain goes
+	if p.previous != nil && len(p.chain) >= p.keep {
+		p.dropped = p.previousReplicas
+		p.previous = nil
+		p.previousReplicas = nil
+	}
+
+	p.cont.CollectCheckpoints(p.heads()...)
+
+	return checkpoint, stats, start, nil
+}
+
+// Heads of the chains, whose generations are kept
+func (p *periodicCheckpoints) heads() []container.Checkpoint {
+	heads := []container.Checkpoint{p.chain[len(p.chain)-1]}
+	if p.previous != nil {
+		heads = append(heads, p.previous)
+	}
+
+	return heads
+}
+
+// Remove the generations, that are not kept anymore, from the storage directory and from
+// the buddies, that have dropped the previous chain
+func (p *periodicCheckpoints) collectCopies() {
+	n := p.nymph
+	rank := p.cont.Rank()
+
+	var live []int
+	for _, head := range p.heads() {
+		for _, ckpt := range container.Chain(head) {
+			live = append(live, ckpt.Generation())
+		}
+	}
+
+	if p.storage != "" {
+		_, err := container.RemoveGenerations(container.StoredCheckpointsPath(p.storage), live)
+		if err != nil {
+			log.WithError(err).WithField("dir", p.storage).Warn("Failed to remove stored checkpoints")
+		}
+	}
+
+	if p.dropped == nil {
+		return
+	}
+
+	buddies := make(map[string]bool)
+	for buddy := range p.dropped {
+		buddies[buddy] = true
+	}
+	for buddy := range p.replicas {
+		buddies[buddy] = true
+	}
+	p.dropped = nil
+
+	for buddy := range buddies {
+		if err := n.dropReplicas(rank, p.cont.ID(), live, buddy); err != nil {
+			log.WithError(err).WithField("buddy", buddy).Warn("Failed to drop old replicas")
+		}
+	}
+}
+
+// Send the generation to the buddies holding the chain. A buddy, that misses a generation,
+// is useless until the next chain starts. Returns the buddies, that hold the generation.
+func (p *periodicCheckpoints) replicate(checkpoint container.Checkpoint) []string {
+	replicas := make([]string, 0, len(p.replicas))
+	for buddy, ok := range p.replicas {
+		if !ok {
+			continue
+		}
+
+		if err := p.nymph.replicate(checkpoint, buddy); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"rank":       p.cont.Rank(),
+				"generation": checkpoint.Generation(),
+				"buddy":      buddy,
+			}).Warn("Replication failed")
+			p.replicas[buddy] = false
+			continue
+		}
+
+		replicas = append(replicas, buddy)
+	}
+
+	return replicas
+}
@@ -0,0 +1,170 @@
+package nymph
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/coordinator"
+)
+
+const (
+	// Transfer progress is reported at most that often
+	progressInterval = time.Second
+
+	// Reports waiting to be sent to the coordinator
+	progressQueue = 16
+)
+
+// Reports the progress of a migration to the coordinator. Migrations without an ID are not
+// tracked by the coordinator, then the reporter is nil and reports nothing. The reports are
+// sent by a goroutine of their own, so that the transfer never waits for the coordinator.
+type progressReporter struct {
+	nymph   *Nymph
+	id      uint64
+	reports chan coordinator.MigrationProgressArgs
+
+	mutex      sync.Mutex
+	phase      coordinator.MigrationPhase
+	bytesSent  int64
+	bytesTotal int64
+	lastReport time.Time
+	// The end of the transfer has been reported
+	complete bool
+	closed   bool
+}
+
+func (n *Nymph) newProgress(id uint64) *progressReporter {
+	if id == 0 {
+		return nil
+	}
+
+	p := &progressReporter{
+		nymph:   n,
+		id:      id,
+		reports: make(chan coordinator.MigrationProgressArgs, progressQueue),
+	}
+
+	go p.run()
+
+	return p
+}
+
+func (p *progressReporter) run() {
+	for args := range p.reports {
+		if err := p.nymph.reportProgress(&args); err != nil {
+			log.WithError(err).WithField("id", p.id).Debug("Failed to report migration progress")
+		}
+	}
+}
+
+// Stop reporting, once the migration is over
+func (p *progressReporter) Close() {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.reports)
+	}
+}
+
+func (p *progressReporter) ID() uint64 {
+	if p == nil {
+		return 0
+	}
+
+	return p.id
+}
+
+// Must be called with the mutex held. If the coordinator falls behind, the report is dropped
+// and the next one catches up. Failed reports do not affect the migration.
+func (p *progressReporter) report() {
+	if p.closed {
+		return
+	}
+
+	p.lastReport = time.Now()
+	p.complete = p.bytesTotal > 0 && p.bytesSent >= p.bytesTotal
+
+	select {
+	case p.reports <- coordinator.MigrationProgressArgs{
+		ID:         p.id,
+		Phase:      p.phase,
+		BytesSent:  p.bytesSent,
+		BytesTotal: p.bytesTotal,
+	}:
+	default:
+		log.WithField("id", p.id).Debug("Coordinator falls behind, dropping progress report")
+	}
+}
+
+func (p *progressReporter) Phase(phase coordinator.MigrationPhase) {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.phase = phase
+	p.report()
+}
+
+// More data is going to be transferred
+func (p *progressReporter) AddTotal(bytes int64) {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.bytesTotal += bytes
+	p.report()
+}
+
+func (p *progressReporter) Sent(bytes int64) {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.bytesSent += bytes
+	if time.Since(p.lastReport) >= progressInterval || (!p.complete && p.bytesSent >= p.bytesTotal) {
+		p.report()
+	}
+}
+
+// Bytes counted as transferred so far
+func (p *progressReporter) BytesSent() int64 {
+	if p == nil {
+		return 0
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.bytesSent
+}
+
+// Go back to the given number of bytes before a resumed transfer. The resumed transfer counts
+// what the recipient has already received once again.
+func (p *progressReporter) Rewind(bytesSent int64) {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.bytesSent = bytesSent
+	p.complete = false
+}
@@ -0,0 +1,43 @@
+package nymph
+
+import (
+	"sync"
+	"time"
+)
+
+// Paces transfers to a fixed rate. Senders reserve bytes before sending them and sleep, until
+// the bytes reserved before theirs have gone out at the rate. A limiter can be shared by
+// several senders.
+type rateLimiter struct {
+	mutex sync.Mutex
+	// Bytes per second
+	rate int64
+	// Time, when the bytes reserved so far have been sent
+	next time.Time
+}
+
+// Create a limiter for the rate in MiB/s. No limiter is needed for non-positive rates.
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		rate: int64(rate) << 20,
+	}
+}
+
+// Wait, until n bytes can be sent
+func (l *rateLimiter) wait(n int64) {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		// Idle time does not accumulate into a burst
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n * int64(time.Second) / l.rate))
+	l.mutex.Unlock()
+
+	time.Sleep(delay)
+}
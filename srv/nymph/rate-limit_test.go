@@ -0,0 +1,69 @@
+package nymph
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Slack for the scheduler, when checking sleeps
+const rateSlack = 50 * time.Millisecond
+
+func TestNoLimiterForNonPositiveRates(t *testing.T) {
+	if newRateLimiter(0) != nil || newRateLimiter(-1) != nil {
+		t.Errorf("Non-positive rates should not be limited")
+	}
+
+	if limiter := newRateLimiter(3); limiter.rate != 3<<20 {
+		t.Errorf("Expected 3 MiB/s, got %v bytes per second", limiter.rate)
+	}
+}
+
+// Send chunks of size through the limiter from several senders. Returns how long it took.
+func sendThrough(limiter *rateLimiter, senders, chunks int, size int64) time.Duration {
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < chunks; j++ {
+				limiter.wait(size)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return time.Since(start)
+}
+
+func TestRateLimiterPacesSenders(t *testing.T) {
+	// 16 MiB at 64 MiB/s is a quarter of a second. The first chunk goes out right away.
+	if elapsed := sendThrough(newRateLimiter(64), 1, 3, 16<<20); elapsed < 500*time.Millisecond-rateSlack || elapsed > 500*time.Millisecond+4*rateSlack {
+		t.Errorf("Three chunks should take half a second, took %v", elapsed)
+	}
+
+	// Senders sharing the limiter share the rate
+	if elapsed := sendThrough(newRateLimiter(64), 2, 2, 16<<20); elapsed < 750*time.Millisecond-rateSlack || elapsed > 750*time.Millisecond+4*rateSlack {
+		t.Errorf("Four chunks of two senders should take 750ms, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterIdleDoesNotBurst(t *testing.T) {
+	limiter := newRateLimiter(64)
+	limiter.wait(16 << 20)
+	time.Sleep(300 * time.Millisecond)
+
+	start := time.Now()
+	limiter.wait(16 << 20)
+	if elapsed := time.Since(start); elapsed > rateSlack {
+		t.Errorf("Sending after a pause should not wait, waited %v", elapsed)
+	}
+
+	start = time.Now()
+	limiter.wait(16 << 20)
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond-rateSlack {
+		t.Errorf("Idle time should not accumulate, waited only %v", elapsed)
+	}
+}
@@ -0,0 +1,114 @@
+package nymph
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/config"
+	"github.com/planetA/konk/pkg/container"
+	. "github.com/planetA/konk/pkg/nymph"
+)
+
+// Nymphs, that keep replicas of the checkpoints taken here
+func (n *Nymph) checkpointBuddies() []string {
+	configured, _ := config.GetStringSliceOk(config.NymphCheckpointBuddies)
+
+	buddies := make([]string, 0, len(configured))
+	for _, buddy := range configured {
+		if buddy != n.hostname {
+			buddies = append(buddies, buddy)
+		}
+	}
+
+	return buddies
+}
+
+// Send the checkpoint to the buddy. The images of the ancestors must be at the buddy
+// already.
+func (n *Nymph) replicate(checkpoint container.Checkpoint, buddy string) error {
+	migration, err := NewMigrationDonor(n.RootDir, buddy, n.migrationLimiters(0), nil)
+	if err != nil {
+		return err
+	}
+	defer migration.Close()
+
+	return migration.Replicate(checkpoint)
+}
+
+// Ask the buddy to drop the replicated generations of the container, except the listed ones
+func (n *Nymph) dropReplicas(rank container.Rank, id string, keep []int, buddy string) error {
+	client, err := NewClientOnce(buddy)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.DropReplicas(rank, id, keep)
+}
+
+// Restore a container from the checkpoint, that a buddy has replicated here
+func (n *Nymph) RestoreReplica(args RestoreReplicaArgs, reply *bool) error {
+	imageInfo := args.Image
+
+	cont, err := n.Containers.Load(imageInfo)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"id":   imageInfo.ID,
+			"rank": imageInfo.Rank,
+		}).Error("Loading replica has failed")
+		return err
+	}
+
+	if err := n.restoreContainer(cont, container.Restore, nil); err != nil {
+		log.WithError(err).WithField("rank", cont.Rank()).Error("Restore failed, dropping the container")
+		n.Containers.Delete(cont)
+		return err
+	}
+
+	if err := n.registerContainer(imageInfo.Rank); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"rank":       imageInfo.Rank,
+		"generation": imageInfo.Generation,
+	}).Info("Container has been restored from a replica")
+
+	*reply = true
+	return nil
+}
+
+// Remove replicated generations, except the ones to keep. Without generations to keep, the
+// state of the container goes as well. Nothing is removed, while the container runs here,
+// because its own checkpoints live in the same directory.
+func (n *Nymph) DropReplicas(args DropReplicasArgs, reply *bool) error {
+	if _, err := n.Containers.Get(args.Rank); err == nil {
+		return fmt.Errorf("Container %v runs at the nymph", args.Rank)
+	}
+
+	dir := path.Join(n.RootDir, container.ContainerCheckpointsPath(args.ID))
+	removed, err := container.RemoveGenerations(dir, args.Keep)
+	if err != nil {
+		log.WithError(err).WithField("dir", dir).Warn("Failed to remove replicas")
+	}
+
+	if len(args.Keep) == 0 {
+		os.Remove(dir)
+		stateDir := path.Join(n.RootDir, path.Dir(container.ContainerStatePath(args.ID)))
+		if err := os.RemoveAll(stateDir); err != nil {
+			log.WithError(err).WithField("dir", stateDir).Warn("Failed to remove replica state")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"rank":    args.Rank,
+		"removed": removed,
+		"kept":    args.Keep,
+	}).Debug("Dropped replicas")
+
+	*reply = true
+	return nil
+}
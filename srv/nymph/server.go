@@ -1,6 +1,7 @@
 package nymph
 
 import (
+	"context"
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
@@ -22,8 +23,14 @@ import (
 	. "github.com/planetA/konk/pkg/nymph"
 )
 
+const (
+	defaultHeartbeatInterval = 2 * time.Second
+)
+
 // Type for the server state of the connection to a nymph daemon
 type Nymph struct {
+	// Protects the connection to the coordinator and the ID assigned by it
+	coordinatorMutex  sync.Mutex
 	coordinatorClient *coordinator.Client
 
 	Containers *container.ContainerRegister
@@ -33,9 +40,23 @@ type Nymph struct {
 
 	networks []network.Network
 
+	tombstones *tombstones
+
+	// Limits the transfer rate of all migrations from the nymph
+	rateLimiter *rateLimiter
+
+	// Containers, that are being sent to other nymphs
+	sendingMutex sync.Mutex
+	sending      map[container.Rank]bool
+	// Signaled, when a container is not sent anymore
+	sendingDone *sync.Cond
+
 	RootDir  string
 	hostname string
 	Id       uint
+
+	// CRIU configuration of the containers
+	criuConfig string
 }
 
 func (n *Nymph) createRootDir() error {
@@ -57,6 +78,12 @@ func (n *Nymph) createRootDir() error {
 		return fmt.Errorf("Failed to change to temporary directory: %v", err)
 	}
 
+	criuConfig, err := container.WriteCriuConfig(n.RootDir)
+	if err != nil {
+		return err
+	}
+	n.criuConfig = criuConfig
+
 	return nil
 }
 
@@ -84,7 +111,10 @@ func NewNymph() (*Nymph, error) {
 		imagesMutex: &sync.Mutex{},
 		images:      make(map[string]*container.Image),
 		networks:    make([]network.Network, 0),
+		tombstones:  newTombstones(),
+		sending:     make(map[container.Rank]bool),
 	}
+	nymph.sendingDone = sync.NewCond(&nymph.sendingMutex)
 
 	// Directory should be create before anybody uses it
 	nymph.RootDir = config.GetString(config.NymphRootDir)
@@ -107,6 +137,9 @@ func NewNymph() (*Nymph, error) {
 
 	nymph.Containers = container.NewContainerRegister(nymph.RootDir)
 
+	totalRateLimit, _ := config.GetIntOk(config.NymphMigrationTotalRateLimit)
+	nymph.rateLimiter = newRateLimiter(totalRateLimit)
+
 	nymph.coordinatorClient, err = coordinator.NewClient()
 	if err != nil {
 		nymph._Close()
@@ -152,19 +185,16 @@ func (n *Nymph) getImage(imagePath string) (*container.Image, error) {
 func (n *Nymph) Signal(args SignalArgs, reply *bool) error {
 	log.WithField("args", args).Debug("Received signal")
 
-	// var err error
-
-	// cont, ok := n.getContainer(args.Rank)
-	// if !ok {
-	// 	return fmt.Errorf("Receiver %v is not known\n", args.Rank)
-	// }
+	cont, err := n.Containers.Get(args.Rank)
+	if err != nil {
+		return fmt.Errorf("Receiver %v is not known: %v", args.Rank, err)
+	}
 
-	panic("Unimplemented")
-	// err = cont.Signal(args.Signal)
-	// if err != nil {
-	// 	return fmt.Errorf("Notifying the init process %v failed: %v", args.Rank, err)
-	// }
+	if err := cont.Signal(args.Signal, false); err != nil {
+		return fmt.Errorf("Notifying the init process %v failed: %v", args.Rank, err)
+	}
 
+	*reply = true
 	return nil
 }
 
@@ -247,16 +277,17 @@ func (n *Nymph) Run(args RunArgs, reply *bool) error {
 		RootlessCgroups:  false,
 	})
 	if err != nil {
-		return fmt.Errorf("Failed converting spec to config", err)
+		return fmt.Errorf("Failed converting spec to config: %v", err)
 	}
 
 	labels := container.NewLabels()
 
-	labels.AddLabel("nymph-id", n.Id)
+	labels.AddLabel("nymph-id", n.nymphId())
 	labels.AddLabel("rank", args.Rank)
 
 	addr := container.CreateContainerAddr(args.Rank)
 	labels.AddLabel("ip", addr.String())
+	labels.AddLabel(container.CriuConfigLabel, n.criuConfig)
 
 	for _, net := range n.networks {
 		if err := net.InstallHooks(contConfig); err != nil {
@@ -284,33 +315,82 @@ func (n *Nymph) Run(args RunArgs, reply *bool) error {
 		return fmt.Errorf("Container creation failed: %v", err)
 	}
 
+	n.tombstones.Del(args.Rank)
+
+	cont.SetCheckpointInterval(checkpointInterval(args.CheckpointInterval))
+
 	if err := cont.Launch(container.Start, args.Args, args.Init); err != nil {
 		return err
 	}
 
-	if err := n.coordinatorClient.RegisterContainer(args.Rank, n.hostname); err != nil {
+	n.watchContainer(cont)
+	n.startPeriodicCheckpoints(cont)
+
+	if err := n.registerContainer(args.Rank); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (n *Nymph) registerNymphOnce() error {
+// Report the ranks of all containers running at the nymph
+func (n *Nymph) ListContainers(args ListContainersArgs, reply *[]container.Rank) error {
+	*reply = n.Containers.Ranks()
+	return nil
+}
+
+// Wait until the process in the container exits
+func (n *Nymph) Wait(args WaitArgs, reply *WaitReply) error {
+	cont, err := n.Containers.Get(args.Rank)
+	if err != nil {
+		if entry, ok := n.tombstones.Get(args.Rank); ok {
+			reply.Status = entry.status
+			reply.Migrated = entry.migrated
+			reply.Checkpointed = entry.checkpointed
+			return nil
+		}
+
+		log.WithError(err).WithField("rank", args.Rank).Debug("Container to wait for not found")
+		return err
+	}
+
+	reply.Status, reply.Migrated = cont.Wait()
+
+	log.WithFields(log.Fields{
+		"rank":     args.Rank,
+		"status":   reply.Status,
+		"migrated": reply.Migrated,
+	}).Debug("Finished waiting for container")
+
+	return nil
+}
+
+func (n *Nymph) registerNymphOnce(fresh bool) error {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return fmt.Errorf("Failed to get hostname: %v", err)
 	}
 
-	if n.Id, err = n.coordinatorClient.RegisterNymph(hostname); err != nil {
+	var id uint
+	err = n.callCoordinator(func(client *coordinator.Client) error {
+		id, err = client.RegisterNymph(hostname, fresh)
+		return err
+	})
+	if err != nil {
 		return fmt.Errorf("Failed to register nymph: %v", err)
 	}
 
+	n.coordinatorMutex.Lock()
+	n.Id = id
+	n.coordinatorMutex.Unlock()
+
 	return nil
 }
 
 func (n *Nymph) registerNymph() error {
 	for {
-		if err := n.registerNymphOnce(); err != nil {
+		// The root directory has just been purged
+		if err := n.registerNymphOnce(true); err != nil {
 			log.Printf("Registration has failed: %v", err)
 		} else {
 			return nil
@@ -321,7 +401,68 @@ func (n *Nymph) registerNymph() error {
 	}
 }
 
+// Register the nymph and all its containers once again. Needed, if the coordinator has
+// forgotten about the nymph, e.g., because it considered the nymph dead. Containers, that
+// the coordinator has restarted elsewhere meanwhile, are destroyed.
+func (n *Nymph) reregisterNymph() error {
+	if err := n.registerNymphOnce(false); err != nil {
+		return err
+	}
+
+	var fenced []container.Rank
+	err := n.callCoordinator(func(client *coordinator.Client) (err error) {
+		fenced, err = client.FencedContainers(n.hostname)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to ask for fenced containers: %v", err)
+	}
+	n.destroyFenced(fenced)
+
+	for _, rank := range n.Containers.Ranks() {
+		if err := n.registerContainer(rank); err != nil {
+			return fmt.Errorf("Failed to register container %v: %v", rank, err)
+		}
+	}
+
+	return nil
+}
+
+// Periodically tell the coordinator that the nymph is alive and report its resources
+func (n *Nymph) heartbeatLoop(ctx context.Context) {
+	interval := defaultHeartbeatInterval
+	if seconds, ok := config.GetIntOk(config.NymphHeartbeatInterval); ok {
+		interval = time.Duration(seconds) * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		metrics := n.collectMetrics()
+		err := n.callCoordinator(func(client *coordinator.Client) error {
+			return client.Heartbeat(n.hostname, metrics)
+		})
+		if err != nil {
+			log.WithError(err).Warn("Heartbeat has failed, registering once again")
+
+			if err := n.reregisterNymph(); err != nil {
+				log.WithError(err).Error("Registration has failed")
+			}
+		}
+	}
+}
+
 func (n *Nymph) unregisterNymph() {
+	n.coordinatorMutex.Lock()
+	defer n.coordinatorMutex.Unlock()
+
 	if n.coordinatorClient == nil {
 		return
 	}
@@ -0,0 +1,325 @@
+package nymph
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+	"github.com/planetA/konk/pkg/coordinator"
+	. "github.com/planetA/konk/pkg/nymph"
+)
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("Failed to copy %v: %v", src, err)
+	}
+
+	// The checkpoint has to survive the node
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// Copy the files of a checkpoint directory. Symlinks are recreated, as they point to
+// the parent images. Directories of generations are copied recursively.
+func copyDir(src, dst string) error {
+	if err := os.MkdirAll(dst, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		srcPath := path.Join(src, file.Name())
+		dstPath := path.Join(dst, file.Name())
+
+		switch {
+		case file.IsDir():
+			if err := copyDir(srcPath, dstPath); err != nil {
+				return err
+			}
+		case file.Mode().IsRegular():
+			if err := copyFile(srcPath, dstPath); err != nil {
+				return err
+			}
+		case file.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return err
+			}
+			os.Remove(dstPath)
+			if err := os.Symlink(target, dstPath); err != nil {
+				return err
+			}
+		default:
+			log.WithField("path", srcPath).Debug("Skipping a file of unsupported type")
+		}
+	}
+
+	return nil
+}
+
+// Launch the container from its latest checkpoint and take care of it, as if it was started
+// here
+func (n *Nymph) restoreContainer(cont *container.Container, startType container.StartType, progress *progressReporter) error {
+	for _, net := range n.networks {
+		if external, ok := net.DeclareExternal(cont.Rank()); ok {
+			cont.AddExternal(external)
+		}
+	}
+
+	n.tombstones.Del(cont.Rank())
+
+	if err := cont.Launch(startType, cont.Args(), cont.Init()); err != nil {
+		return err
+	}
+
+	// Older chains, that have come along with the checkpoint, are of no use anymore
+	cont.CollectCheckpoints(cont.LatestCheckpoint())
+
+	n.watchContainer(cont)
+	n.startPeriodicCheckpoints(cont)
+
+	progress.Phase(coordinator.PhaseNetwork)
+	for _, net := range n.networks {
+		if err := net.PostRestore(cont); err != nil {
+			return err
+		}
+	}
+
+	status, err := cont.Status()
+	if err != nil {
+		log.WithError(err).Error("Quering status failed")
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"cont":   cont.ID(),
+		"status": status,
+	}).Debug("Container has been restored")
+
+	return nil
+}
+
+// Copy the state file and the images of the checkpoint to the storage directory. The images
+// of the ancestors must be stored already. The description goes last, so that an
+// interrupted copy does not look like a checkpoint.
+func (n *Nymph) storeCheckpoint(checkpoint container.Checkpoint, dir string, stats container.DumpStats) (*container.StoredCheckpoint, error) {
+	if err := os.MkdirAll(dir, os.ModeDir|0770); err != nil {
+		return nil, fmt.Errorf("Failed to create storage directory: %v", err)
+	}
+
+	err := copyFile(path.Join(n.RootDir, checkpoint.StatePath()), container.StoredStatePath(dir))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to store the state file: %v", err)
+	}
+
+	if err := copyDir(checkpoint.PathAbs(), container.StoredImagesPath(dir, checkpoint.Generation())); err != nil {
+		return nil, fmt.Errorf("Failed to store the images: %v", err)
+	}
+
+	stored := &container.StoredCheckpoint{
+		Image:    *checkpoint.ImageInfo(),
+		Stats:    stats,
+		Hostname: n.hostname,
+		Created:  time.Now(),
+	}
+
+	if err := container.SaveStoredCheckpoint(dir, stored); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// Handle a checkpoint, that failed after the process might have been dumped. The process
+// is restored from the local images, like after a failed migration.
+func (n *Nymph) failCheckpoint(cont *container.Container, cause error) error {
+	if !cont.Stopped() {
+		cont.SetMigrating(false)
+		return cause
+	}
+
+	log.WithError(cause).WithField("rank", cont.Rank()).Warn("Checkpoint failed, restoring the container")
+
+	if err := n.rollback(cont); err != nil {
+		log.WithError(err).WithField("rank", cont.Rank()).Error("Restore failed, container is lost")
+		n.Containers.Delete(cont)
+		n.unregisterContainer(cont.Rank())
+		return fmt.Errorf("%v; restore failed: %v", cause, err)
+	}
+
+	return cause
+}
+
+// Dump the container into a storage directory, that outlives the nymph. Unless asked to
+// leave it running, the container is gone from the nymph afterwards.
+func (n *Nymph) Checkpoint(args CheckpointArgs, reply *CheckpointReply) error {
+	if !path.IsAbs(args.Dir) {
+		return fmt.Errorf("Storage directory must be an absolute path")
+	}
+
+	if container.IsStoredCheckpoint(args.Dir) {
+		return fmt.Errorf("Directory %v holds a checkpoint already", args.Dir)
+	}
+
+	cont, err := n.Containers.Get(args.Rank)
+	if err != nil {
+		log.WithError(err).WithField("rank", args.Rank).Error("Container not found")
+		return err
+	}
+
+	// The container must not migrate, while it is dumped
+	if err := n.startSending(args.Rank); err != nil {
+		return err
+	}
+	defer n.stopSending(args.Rank)
+
+	checkpoint, err := cont.NewCheckpoint(nil)
+	if err != nil {
+		return err
+	}
+
+	if !args.LeaveRunning {
+		cont.SetMigrating(true)
+	}
+
+	start := time.Now()
+	if err := checkpoint.Dump(container.DumpOpts{LeaveRunning: args.LeaveRunning}); err != nil {
+		return n.failCheckpoint(cont, err)
+	}
+
+	stats, err := checkpoint.Stats()
+	if err != nil {
+		log.WithError(err).Warn("Failed to read dump statistics")
+		stats = &container.DumpStats{Generation: checkpoint.Generation()}
+	}
+	stats.Elapsed = time.Since(start)
+
+	stored, err := n.storeCheckpoint(checkpoint, args.Dir, *stats)
+	if err != nil {
+		os.RemoveAll(container.StoredCheckpointsPath(args.Dir))
+		os.Remove(container.StoredStatePath(args.Dir))
+		return n.failCheckpoint(cont, err)
+	}
+
+	log.WithFields(log.Fields{
+		"rank":          args.Rank,
+		"dir":           args.Dir,
+		"elapsed":       time.Since(start),
+		"pages-written": stats.PagesWritten,
+	}).Info("Checkpoint has been stored")
+
+	// The stored copy is the one, that matters
+	if args.LeaveRunning {
+		if err := cont.RemoveCheckpoint(checkpoint.Generation()); err != nil {
+			log.WithError(err).WithField("rank", args.Rank).Warn("Failed to remove the local checkpoint")
+		}
+	} else {
+		// Waiters learn, that the container has not exited, but will not come back either
+		n.tombstones.AddCheckpointed(args.Rank)
+		n.Containers.Delete(cont)
+		cont.CollectCheckpoints()
+
+		if err := n.unregisterContainer(args.Rank); err != nil {
+			log.WithError(err).WithField("rank", args.Rank).Error("Failed to unregister container")
+		}
+	}
+
+	reply.Image = stored.Image
+	reply.Stats = stored.Stats
+	return nil
+}
+
+// Restore a container from a storage directory written by Checkpoint
+func (n *Nymph) Restore(args RestoreArgs, reply *container.Rank) error {
+	stored, err := container.LoadStoredCheckpoint(args.Dir)
+	if err != nil {
+		return err
+	}
+	imageInfo := stored.Image
+
+	if _, err := n.Containers.Get(imageInfo.Rank); err == nil {
+		return fmt.Errorf("Container %v is running at the nymph already", imageInfo.Rank)
+	}
+
+	stateDir := path.Join(n.RootDir, path.Dir(container.ContainerStatePath(imageInfo.ID)))
+	imagesDir := path.Join(n.RootDir, path.Dir(container.CheckpointPath(imageInfo.ID, imageInfo.Generation)))
+	cleanup := func() {
+		os.RemoveAll(stateDir)
+		os.RemoveAll(imagesDir)
+	}
+
+	if err := os.MkdirAll(stateDir, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := copyFile(container.StoredStatePath(args.Dir), path.Join(n.RootDir, container.ContainerStatePath(imageInfo.ID))); err != nil {
+		cleanup()
+		return fmt.Errorf("Failed to copy the state file: %v", err)
+	}
+
+	if err := copyDir(container.StoredCheckpointsPath(args.Dir), imagesDir); err != nil {
+		cleanup()
+		return fmt.Errorf("Failed to copy the images: %v", err)
+	}
+
+	cont, err := n.Containers.Load(imageInfo)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"id":   imageInfo.ID,
+			"rank": imageInfo.Rank,
+		}).Error("Loading container has failed")
+		cleanup()
+		return err
+	}
+
+	if err := n.restoreContainer(cont, container.Restore, nil); err != nil {
+		log.WithError(err).WithField("rank", cont.Rank()).Error("Restore failed, dropping the container")
+		n.Containers.Delete(cont)
+		return err
+	}
+
+	if err := n.registerContainer(imageInfo.Rank); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"rank":    imageInfo.Rank,
+		"dir":     args.Dir,
+		"created": stored.Created,
+		"from":    stored.Hostname,
+	}).Info("Container has been restored from storage")
+
+	*reply = imageInfo.Rank
+	return nil
+}
@@ -0,0 +1,121 @@
+package nymph
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/planetA/konk/pkg/container"
+)
+
+const (
+	// How long the exit status of a finished container is kept for late waiters
+	tombstoneTTL = 5 * time.Minute
+)
+
+// What became of a container, that was removed from the nymph
+type tombstone struct {
+	status container.ExitStatus
+	// The container did not exit, but has migrated to another nymph
+	migrated bool
+	// The container was stopped after a dump into a storage directory
+	checkpointed bool
+}
+
+// Exit statuses of containers that have finished or migrated and were removed from the nymph
+type tombstones struct {
+	mutex      sync.Mutex
+	tombstones map[container.Rank]*tombstone
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{
+		tombstones: make(map[container.Rank]*tombstone),
+	}
+}
+
+func (t *tombstones) add(rank container.Rank, entry *tombstone) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.tombstones[rank] = entry
+
+	time.AfterFunc(tombstoneTTL, func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		if cur, ok := t.tombstones[rank]; ok && cur == entry {
+			delete(t.tombstones, rank)
+		}
+	})
+}
+
+func (t *tombstones) Add(rank container.Rank, status container.ExitStatus) {
+	t.add(rank, &tombstone{status: status})
+}
+
+// The container has left the nymph, waiters should ask the coordinator for its new place
+func (t *tombstones) AddMigrated(rank container.Rank) {
+	t.add(rank, &tombstone{migrated: true})
+}
+
+// The container has been stopped by a checkpoint, waiters should not look for it anymore
+func (t *tombstones) AddCheckpointed(rank container.Rank) {
+	t.add(rank, &tombstone{checkpointed: true})
+}
+
+// Returns what became of the container
+func (t *tombstones) Get(rank container.Rank) (tombstone, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry, ok := t.tombstones[rank]
+	if !ok {
+		return tombstone{}, false
+	}
+
+	return *entry, true
+}
+
+func (t *tombstones) Del(rank container.Rank) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.tombstones, rank)
+}
+
+// Wait for the process in the container to finish and clean up after it: destroy the
+// container, tell the coordinator that the container is gone, and remember the exit status.
+func (n *Nymph) watchContainer(cont *container.Container) {
+	go func() {
+		status, migrated := cont.Wait()
+		if migrated {
+			// The donor side of the migration takes care of the container
+			return
+		}
+
+		rank := cont.Rank()
+		log.WithFields(log.Fields{
+			"rank":   rank,
+			"status": status,
+		}).Info("Container process has finished")
+
+		n.tombstones.Add(rank, status)
+
+		// A periodic checkpoint may be dumped still, the container goes only after it
+		n.waitSending(rank)
+		defer n.stopSending(rank)
+
+		if !n.Containers.Delete(cont) {
+			return
+		}
+
+		// The process has finished, nobody restores it from the checkpoints anymore
+		cont.CollectCheckpoints()
+
+		if err := n.unregisterContainer(rank); err != nil {
+			log.WithError(err).WithField("rank", rank).Error("Failed to unregister container")
+		}
+	}()
+}